@@ -12,9 +12,18 @@ type Seller struct{}
 
 func (Seller) Name() string { return "Seller" }
 
-type Buyer struct{}
+// Buyer is the buying location. Buyers with an ID are instances of the role, so one
+// seller can serve many of them at once, each in a session of its own.
+type Buyer struct {
+	ID string
+}
 
-func (Buyer) Name() string { return "Buyer" }
+func (b Buyer) Name() string {
+	if b.ID == "" {
+		return "Buyer"
+	}
+	return "Buyer/" + b.ID
+}
 
 // Helper function for book lookup
 func getBook(title string) (price int, deliveryDate time.Time, found bool) {
@@ -34,6 +43,22 @@ const BUDGET = 100
 type BooksellerChoreography struct {
 	Title  Located
 	Budget Located
+	// Buyer is the instance buying; the zero value is the one Buyer{}.
+	Buyer Buyer
+}
+
+// Participants scopes a session to the seller and its buyer, leaving out the other buyers.
+func (c BooksellerChoreography) Participants() []Location {
+	return []Location{Seller{}, c.Buyer}
+}
+
+func init() {
+	RegisterChoreography(BooksellerChoreography{}, ChoreographyInfo{
+		Name:        "Bookseller",
+		Locations:   []string{Seller{}.Name(), Buyer{}.Name()},
+		Version:     "1",
+		Description: "a buyer asks the seller for a book's price and buys it if it's within budget",
+	})
 }
 
 func toInt(v any) int {
@@ -67,7 +92,7 @@ func toDate(v any) time.Time {
 func (c BooksellerChoreography) Run(op ChoreoOp) interface{} {
 
 	// Buyer sends title of book they want to
-	titleAtSeller := op.Comm(Buyer{}, Seller{}, c.Title)
+	titleAtSeller := op.Comm(c.Buyer, Seller{}, c.Title)
 	fmt.Printf("Title at seller: %v from op: %v\n", titleAtSeller.Value, op.(ProjectorChoreoOp).Target.Name())
 	priceAtSeller := op.Locally(Seller{}, func() interface{} {
 		title := titleAtSeller.Value.(string)
@@ -79,8 +104,8 @@ func (c BooksellerChoreography) Run(op ChoreoOp) interface{} {
 		return nil
 	})
 
-	priceAtBuyer := op.Comm(Seller{}, Buyer{}, priceAtSeller)
-	decisionAtBuyer := op.Locally(Buyer{}, func() interface{} {
+	priceAtBuyer := op.Comm(Seller{}, c.Buyer, priceAtSeller)
+	decisionAtBuyer := op.Locally(c.Buyer, func() interface{} {
 		if priceAtBuyer.Value != nil {
 			price := toInt(priceAtBuyer.Value)
 			fmt.Printf("Buyer: Price is %d\n", price)
@@ -94,26 +119,28 @@ func (c BooksellerChoreography) Run(op ChoreoOp) interface{} {
 		fmt.Println("The book does not exist")
 		return false
 	})
-	decision := op.Broadcast(Buyer{}, decisionAtBuyer).(bool)
-	if decision {
-		deliveryDateAtSeller := op.Locally(Seller{}, func() interface{} {
-			title := titleAtSeller.Value.(string)
-			_, deliveryDate, _ := getBook(title)
-			return deliveryDate
-		})
-		deliveryDateAtBuyer := op.Comm(Seller{}, Buyer{}, deliveryDateAtSeller)
-		op.Locally(Buyer{}, func() interface{} {
-			deliveryDate := toDate(deliveryDateAtBuyer.Value)
-			fmt.Printf("The book will be delivered on %s\n", deliveryDate.Format(time.RFC3339))
-			return nil
-		})
-	} else {
-		op.Locally(Buyer{}, func() interface{} {
-			fmt.Println("The buyer cannot buy the book")
-			return nil
-		})
-	}
-	return decision
+	return op.Cond(c.Buyer, []Location{Seller{}}, decisionAtBuyer, func(op ChoreoOp, choice interface{}) interface{} {
+		decision := choice.(bool)
+		if decision {
+			deliveryDateAtSeller := op.Locally(Seller{}, func() interface{} {
+				title := titleAtSeller.Value.(string)
+				_, deliveryDate, _ := getBook(title)
+				return deliveryDate
+			})
+			deliveryDateAtBuyer := op.Comm(Seller{}, c.Buyer, deliveryDateAtSeller)
+			op.Locally(c.Buyer, func() interface{} {
+				deliveryDate := toDate(deliveryDateAtBuyer.Value)
+				fmt.Printf("The book will be delivered on %s\n", deliveryDate.Format(time.RFC3339))
+				return nil
+			})
+		} else {
+			op.Locally(c.Buyer, func() interface{} {
+				fmt.Println("The buyer cannot buy the book")
+				return nil
+			})
+		}
+		return decision
+	})
 }
 
 // 4. RunBookSellerProtocol: creates transports, projectors, and runs each endpoint
@@ -147,3 +174,61 @@ func RunBookSellerProtocol(title string, transport Transport) {
 
 	wg.Wait()
 }
+
+// RunBookSellerSessions runs a session for each buyer, keyed by ID, buying the given
+// title, against one seller endpoint serving them all at once. It returns each buyer's decision.
+// Buyers join the transport's membership, if it has one, for the length of their session.
+func RunBookSellerSessions(titles map[string]string, transport Transport) map[string]interface{} {
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	decisions := make(map[string]interface{})
+	for id, title := range titles {
+		buyer := Buyer{ID: id}
+		m := membershipOf(transport)
+		if m != nil {
+			m.AddLocation(buyer.Name())
+		}
+		var session sync.WaitGroup
+		session.Add(2)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			session.Wait()
+			if m != nil {
+				m.RemoveLocation(buyer.Name())
+			}
+		}()
+
+		// the seller's side of this buyer's session
+		go func() {
+			defer session.Done()
+			sellerProjector := NewProjector(Seller{}, transport)
+			sellerProjector.Session = "books/" + id
+			sellerProjector.EppAndRun(
+				BooksellerChoreography{
+					Title:  sellerProjector.Remote(buyer),
+					Budget: sellerProjector.Remote(buyer),
+					Buyer:  buyer,
+				},
+			)
+		}()
+
+		go func() {
+			defer session.Done()
+			buyerProjector := NewProjector(buyer, transport)
+			buyerProjector.Session = "books/" + id
+			decision := buyerProjector.EppAndRun(
+				BooksellerChoreography{
+					Title:  buyerProjector.Local(title),
+					Budget: buyerProjector.Local(BUDGET),
+					Buyer:  buyer,
+				},
+			)
+			lock.Lock()
+			decisions[id] = decision
+			lock.Unlock()
+		}()
+	}
+	wg.Wait()
+	return decisions
+}
@@ -0,0 +1,22 @@
+package capoeira
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSellerServesManyBuyers(t *testing.T) {
+	titles := map[string]string{"b-1": "TAPL", "b-2": "HoTT", "b-3": "TAPL", "b-4": "SICP", "b-5": "TAPL"}
+	transport := NewChannelTransport([]string{Seller{}.Name()})
+	decisions := RunBookSellerSessions(titles, transport)
+
+	for id, title := range titles {
+		// only TAPL is in stock within budget
+		if want := title == "TAPL"; decisions[id] != want {
+			t.Errorf("expected buyer %s buying %s to decide %v, got %v", id, title, want, decisions[id])
+		}
+	}
+	if locations := transport.Locations(); !slices.Equal(locations, []string{Seller{}.Name()}) {
+		t.Errorf("expected the buyers to leave once done, got %v", locations)
+	}
+}
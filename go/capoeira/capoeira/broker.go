@@ -0,0 +1,368 @@
+package capoeira
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// Broker is an in-process message broker with the delivery semantics of Pub/Sub,
+// for tests and single-process deployments.
+type Broker struct {
+	lock          sync.Mutex
+	topics        map[string][]*Subscription
+	subscriptions map[string]*Subscription
+	ackDeadline   time.Duration
+	published     uint64
+}
+
+// BrokerOption configures a Broker.
+type BrokerOption func(*Broker)
+
+// WithAckDeadline sets how long a subscriber has to acknowledge a message before it
+// is delivered again. The default is 10s.
+func WithAckDeadline(d time.Duration) BrokerOption {
+	return func(b *Broker) {
+		b.ackDeadline = d
+	}
+}
+
+// ErrNoTopic is returned for a topic that wasn't created.
+var ErrNoTopic = errors.New("capoeira: no such topic")
+
+func NewBroker(opts ...BrokerOption) *Broker {
+	b := &Broker{
+		topics:        make(map[string][]*Subscription),
+		subscriptions: make(map[string]*Subscription),
+		ackDeadline:   10 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// CreateTopic creates a topic, unless it exists.
+func (b *Broker) CreateTopic(name string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if _, ok := b.topics[name]; !ok {
+		b.topics[name] = nil
+	}
+}
+
+// CreateSubscription subscribes to a topic, getting the messages published from now
+// on whose attributes include every attribute in filter. If the subscription exists
+// it is returned, so its subscribers share its messages.
+func (b *Broker) CreateSubscription(name, topic string, filter map[string]string) (*Subscription, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if s, ok := b.subscriptions[name]; ok {
+		if s.topic != topic {
+			return nil, fmt.Errorf("subscription %s is to %s, not %s", name, s.topic, topic)
+		}
+		return s, nil
+	}
+	if _, ok := b.topics[topic]; !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNoTopic, topic)
+	}
+	s := &Subscription{
+		name:        name,
+		topic:       topic,
+		filter:      maps.Clone(filter),
+		ackDeadline: b.ackDeadline,
+		arrived:     make(chan struct{}),
+	}
+	b.topics[topic] = append(b.topics[topic], s)
+	b.subscriptions[name] = s
+	return s, nil
+}
+
+// Publish publishes a message to a topic and returns its ID. It never waits for
+// subscribers.
+func (b *Broker) Publish(ctx context.Context, topic string, data []byte, attributes map[string]string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	b.lock.Lock()
+	subs, ok := b.topics[topic]
+	if !ok {
+		b.lock.Unlock()
+		return "", fmt.Errorf("%w: %s", ErrNoTopic, topic)
+	}
+	b.published++
+	seq := b.published
+	b.lock.Unlock()
+	id := strconv.FormatUint(seq, 10)
+	for _, s := range subs {
+		if s.matches(attributes) {
+			s.add(&brokerEntry{seq: seq, id: id, data: data, attributes: maps.Clone(attributes), published: time.Now()})
+		}
+	}
+	return id, nil
+}
+
+// Subscription is a Broker's queue of the messages of a topic for one subscriber,
+// or several sharing the load.
+type Subscription struct {
+	name        string
+	topic       string
+	filter      map[string]string
+	ackDeadline time.Duration
+	lock        sync.Mutex
+	// ready are the messages waiting to be delivered, in the order they were
+	// published; arrived is closed and replaced when one is added
+	ready   []*brokerEntry
+	arrived chan struct{}
+}
+
+// brokerEntry is a message held by a subscription until acknowledged.
+type brokerEntry struct {
+	seq        uint64
+	id         string
+	data       []byte
+	attributes map[string]string
+	published  time.Time
+	// attempts counts deliveries; a delivery's ack or nack only counts while it's the latest
+	attempts int
+	expiry   *time.Timer
+}
+
+// BrokerMessage is a delivery of a message to a subscriber, which must Ack it once
+// handled, or Nack it to have it delivered again.
+type BrokerMessage struct {
+	ID          string
+	Data        []byte
+	Attributes  map[string]string
+	PublishTime time.Time
+	// DeliveryAttempt is 1 the first time the message is delivered.
+	DeliveryAttempt int
+	sub             *Subscription
+	entry           *brokerEntry
+}
+
+func (s *Subscription) matches(attributes map[string]string) bool {
+	for k, v := range s.filter {
+		if attributes[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// add queues an entry to be delivered, in publish order.
+func (s *Subscription) add(e *brokerEntry) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	i, _ := slices.BinarySearchFunc(s.ready, e.seq, func(r *brokerEntry, seq uint64) int {
+		return cmp.Compare(r.seq, seq)
+	})
+	s.ready = slices.Insert(s.ready, i, e)
+	close(s.arrived)
+	s.arrived = make(chan struct{})
+}
+
+// next waits until ctx is done for a message to deliver, leasing it to the
+// subscriber until the ack deadline.
+func (s *Subscription) next(ctx context.Context) (*BrokerMessage, error) {
+	for {
+		s.lock.Lock()
+		if len(s.ready) > 0 {
+			e := s.ready[0]
+			s.ready = s.ready[1:]
+			e.attempts++
+			attempt := e.attempts
+			e.expiry = time.AfterFunc(s.ackDeadline, func() { s.release(e, attempt) })
+			s.lock.Unlock()
+			return &BrokerMessage{
+				ID:              e.id,
+				Data:            e.data,
+				Attributes:      maps.Clone(e.attributes),
+				PublishTime:     e.published,
+				DeliveryAttempt: attempt,
+				sub:             s,
+				entry:           e,
+			}, nil
+		}
+		arrived := s.arrived
+		s.lock.Unlock()
+		select {
+		case <-arrived:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// release queues an entry to be delivered again, if the given delivery of it is
+// still leased.
+func (s *Subscription) release(e *brokerEntry, attempt int) {
+	if s.settle(e, attempt) {
+		s.add(e)
+	}
+}
+
+// settle ends the lease of a delivery, reporting false if it had already ended.
+func (s *Subscription) settle(e *brokerEntry, attempt int) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if e.attempts != attempt || e.expiry == nil {
+		return false
+	}
+	e.expiry.Stop()
+	e.expiry = nil
+	return true
+}
+
+// Ack acknowledges the message, so it isn't delivered again. Acking a delivery whose
+// ack deadline passed does nothing, as the message was queued again.
+func (m *BrokerMessage) Ack() {
+	m.sub.settle(m.entry, m.DeliveryAttempt)
+}
+
+// Nack has the message delivered again right away.
+func (m *BrokerMessage) Nack() {
+	m.sub.release(m.entry, m.DeliveryAttempt)
+}
+
+// Receive calls f with each message delivered to the subscription, one at a time,
+// until ctx is done, and then returns nil. A message f doesn't Ack or Nack is
+// delivered again once its ack deadline passes.
+func (s *Subscription) Receive(ctx context.Context, f func(context.Context, *BrokerMessage)) error {
+	for ctx.Err() == nil {
+		msg, err := s.next(ctx)
+		if err != nil {
+			break
+		}
+		f(ctx, msg)
+	}
+	return nil
+}
+
+// BrokerTransport carries messages through a Broker the way PubSubTransport does
+// through Pub/Sub, with a topic per location and a subscription per sender.
+type BrokerTransport struct {
+	broker        *Broker
+	locations     []string
+	subscriptions map[string]*Subscription
+	// Logger traces messages at debug level and reports failures; nil uses DefaultLogger.
+	Logger *slog.Logger
+	// Metrics, if set, counts messages per (from, to) pair.
+	Metrics *Metrics
+}
+
+// NewBrokerTransport creates the topics and subscriptions of the locations on broker,
+// or uses them if another transport created them already.
+func NewBrokerTransport(broker *Broker, locations []string) (*BrokerTransport, error) {
+	t := &BrokerTransport{broker: broker, locations: slices.Clone(locations), subscriptions: make(map[string]*Subscription)}
+	for _, at := range locations {
+		broker.CreateTopic(at)
+	}
+	for _, at := range locations {
+		for _, from := range locations {
+			sub, err := broker.CreateSubscription(at+"-from-"+from, at, map[string]string{"from": from})
+			if err != nil {
+				return nil, err
+			}
+			t.subscriptions[from+"->"+at] = sub
+		}
+	}
+	return t, nil
+}
+
+func (t *BrokerTransport) logger() *slog.Logger {
+	if t.Logger != nil {
+		return t.Logger
+	}
+	return DefaultLogger()
+}
+
+func (t *BrokerTransport) Send(from, to string, data interface{}) {
+	if err := t.SendContext(context.Background(), from, to, data); err != nil {
+		t.logger().Error("send failed", "location", from, "peer", to, "err", err)
+	}
+}
+
+// SendContext publishes the message, propagating the trace context of ctx in its attributes.
+func (t *BrokerTransport) SendContext(ctx context.Context, from, to string, data interface{}) error {
+	size, err := t.send(ctx, from, to, data)
+	t.Metrics.ObserveSend(from, to, size, err)
+	return err
+}
+
+// send publishes the message and returns the size of its data.
+func (t *BrokerTransport) send(ctx context.Context, from, to string, data interface{}) (int, error) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return 0, fmt.Errorf("marshaling data: %w", err)
+	}
+	attributes := map[string]string{
+		"from": from,
+		"to":   to,
+	}
+	InjectTrace(ctx, propagation.MapCarrier(attributes))
+	id, err := t.broker.Publish(ctx, to, b, attributes)
+	if err != nil {
+		return 0, fmt.Errorf("failed to publish: %w", err)
+	}
+	t.logger().Debug("published message", "location", from, "peer", to, "id", id)
+	return len(b), nil
+}
+
+func (t *BrokerTransport) Receive(from, at string) interface{} {
+	received, _, err := t.ReceiveContext(context.Background(), from, at)
+	if err != nil {
+		t.logger().Error("receive failed", "location", at, "peer", from, "err", err)
+	}
+	return received
+}
+
+// ReceiveContext waits for a message from the peer, extracting the trace context from its attributes.
+func (t *BrokerTransport) ReceiveContext(ctx context.Context, from, at string) (interface{}, context.Context, error) {
+	sub, ok := t.subscriptions[from+"->"+at]
+	if !ok {
+		return nil, ctx, fmt.Errorf("subscription %s->%s not found", from, at)
+	}
+	var received interface{}
+	var size int
+	var got bool
+	remote := ctx
+	start := time.Now()
+	cctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sub.Receive(cctx, func(_ context.Context, msg *BrokerMessage) {
+		if err := json.Unmarshal(msg.Data, &received); err != nil {
+			t.logger().Error("dropping undecodable message", "location", at, "peer", from, "err", err)
+			msg.Ack()
+			return
+		}
+		got, size = true, len(msg.Data)
+		remote = ExtractTrace(ctx, propagation.MapCarrier(msg.Attributes))
+		msg.Ack()
+		cancel()
+	})
+	if !got {
+		return nil, ctx, fmt.Errorf("failed to receive: %w", ctx.Err())
+	}
+	t.Metrics.ObserveReceive(from, at, size, start)
+	t.logger().Debug("received", "location", at, "peer", from, "data", received)
+	return received, remote, nil
+}
+
+func (t *BrokerTransport) Locations() []string {
+	return t.locations
+}
+
+func (t *BrokerTransport) Codec() string {
+	return "json"
+}
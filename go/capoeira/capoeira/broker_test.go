@@ -0,0 +1,86 @@
+package capoeira
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+)
+
+func TestBrokerRedeliversUntilAcked(t *testing.T) {
+	broker := NewBroker()
+	broker.CreateTopic("orders")
+	sub, err := broker.CreateSubscription("printer", "orders", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit, err := broker.CreateSubscription("audit", "orders", map[string]string{"kind": "audit"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := broker.Publish(context.Background(), "returns", []byte("first"), nil); !errors.Is(err, ErrNoTopic) {
+		t.Fatalf("expected publishing to a missing topic to fail, got %v", err)
+	}
+	for i, order := range []string{"first", "second"} {
+		id, err := broker.Publish(context.Background(), "orders", []byte(order), map[string]string{"kind": "order"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := strconv.Itoa(i + 1); id != want {
+			t.Errorf("expected %s to be message %s, got %s", order, want, id)
+		}
+	}
+
+	// the first is nacked, then left until its deadline passes, then acked
+	var deliveries []string
+	var leased *BrokerMessage
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sub.Receive(ctx, func(_ context.Context, msg *BrokerMessage) {
+		deliveries = append(deliveries, string(msg.Data))
+		switch {
+		case string(msg.Data) == "second":
+			msg.Ack()
+			// the first's deadline passes, as its timer would have it, so acking it is too late
+			sub.release(leased.entry, leased.DeliveryAttempt)
+			leased.Ack()
+		case msg.DeliveryAttempt == 1:
+			msg.Nack()
+		case msg.DeliveryAttempt == 2:
+			leased = msg
+		case msg.DeliveryAttempt == 3:
+			msg.Ack()
+			cancel()
+		}
+	})
+	want := []string{"first", "first", "second", "first"}
+	if len(deliveries) != len(want) {
+		t.Fatalf("expected deliveries %v, got %v", want, deliveries)
+	}
+	for i := range want {
+		if deliveries[i] != want[i] {
+			t.Fatalf("expected deliveries %v, got %v", want, deliveries)
+		}
+	}
+
+	// everything was acked, and the audit subscription filtered everything out
+	for _, s := range []*Subscription{sub, audit} {
+		s.lock.Lock()
+		ready := len(s.ready)
+		s.lock.Unlock()
+		if ready != 0 {
+			t.Errorf("expected nothing left to deliver to %s, got %d messages", s.name, ready)
+		}
+	}
+}
+
+func TestBrokerTransportRunsChoreography(t *testing.T) {
+	transport, err := NewBrokerTransport(NewBroker(), []string{Ticketer{}.Name(), ParkingAuthority{}.Name(), Printer{}.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := runAll(transport, relayChoreography{}, Ticketer{}, ParkingAuthority{}, Printer{})
+	if got := results[Ticketer{}.Name()]; got != "ticket" {
+		t.Errorf("expected the ticket to reach the ticketer, got %v", got)
+	}
+}
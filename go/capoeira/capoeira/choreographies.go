@@ -0,0 +1,79 @@
+package capoeira
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ChoreographyInfo describes a registered choreography, for tooling that needs to
+// know what it involves without running it.
+type ChoreographyInfo struct {
+	Name string
+	// Locations are the names of the locations taking part. A role with instances,
+	// like Buyer, is listed by the role's name.
+	Locations   []string
+	Version     string
+	Description string
+	typ         reflect.Type
+}
+
+var choreographies struct {
+	lock   sync.RWMutex
+	byName map[string]ChoreographyInfo
+	byType map[reflect.Type]string
+}
+
+// RegisterChoreography registers the type of choreo under info.Name, or the type's
+// name if it has none. Call it from init; it panics if the name is taken.
+func RegisterChoreography(choreo Choreography, info ChoreographyInfo) {
+	info.typ = reflect.TypeOf(choreo)
+	if info.Name == "" {
+		info.Name = info.typ.Name()
+	}
+	info.Locations = slices.Clone(info.Locations)
+	choreographies.lock.Lock()
+	defer choreographies.lock.Unlock()
+	if choreographies.byName == nil {
+		choreographies.byName = make(map[string]ChoreographyInfo)
+		choreographies.byType = make(map[reflect.Type]string)
+	}
+	if _, ok := choreographies.byName[info.Name]; ok {
+		panic(fmt.Sprintf("capoeira: choreography %s registered twice", info.Name))
+	}
+	choreographies.byName[info.Name] = info
+	choreographies.byType[info.typ] = info.Name
+}
+
+// Choreographies returns every registered choreography, sorted by name.
+func Choreographies() []ChoreographyInfo {
+	choreographies.lock.RLock()
+	defer choreographies.lock.RUnlock()
+	infos := make([]ChoreographyInfo, 0, len(choreographies.byName))
+	for _, info := range choreographies.byName {
+		infos = append(infos, info)
+	}
+	slices.SortFunc(infos, func(a, b ChoreographyInfo) int { return strings.Compare(a.Name, b.Name) })
+	return infos
+}
+
+// LookupChoreography returns the choreography registered under name.
+func LookupChoreography(name string) (ChoreographyInfo, bool) {
+	choreographies.lock.RLock()
+	defer choreographies.lock.RUnlock()
+	info, ok := choreographies.byName[name]
+	return info, ok
+}
+
+// registeredInfo returns what was registered for the type of choreo.
+func registeredInfo(choreo Choreography) (ChoreographyInfo, bool) {
+	choreographies.lock.RLock()
+	defer choreographies.lock.RUnlock()
+	name, ok := choreographies.byType[reflect.TypeOf(choreo)]
+	if !ok {
+		return ChoreographyInfo{}, false
+	}
+	return choreographies.byName[name], true
+}
@@ -0,0 +1,31 @@
+package capoeira
+
+import "testing"
+
+func TestRegisteredChoreographiesFitTopology(t *testing.T) {
+	bookseller, ok := LookupChoreography("Bookseller")
+	if !ok {
+		t.Fatal("expected the bookseller choreography to be registered")
+	}
+	ticketing, ok := LookupChoreography("Ticketing")
+	if !ok {
+		t.Fatal("expected the ticketing choreography to be registered")
+	}
+	topology := &Topology{Locations: map[string]LocationConfig{
+		Seller{}.Name():           {},
+		Buyer{ID: "b-17"}.Name():  {},
+		ParkingAuthority{}.Name(): {},
+		Ticketer{}.Name():         {},
+	}}
+	if err := topology.Supports(bookseller); err != nil {
+		t.Errorf("expected a buyer instance to stand for the role: %v", err)
+	}
+	if err := topology.Supports(ticketing); err == nil {
+		t.Errorf("expected ticketing to need a printer")
+	}
+
+	hs := handshakeFor(BooksellerChoreography{}, NewChannelTransport(nil))
+	if hs.Choreography != "Bookseller" || hs != handshakeFor(BooksellerChoreography{Buyer: Buyer{ID: "b-17"}}, NewChannelTransport(nil)) {
+		t.Errorf("expected the registered name and version in the handshake, got %+v", hs)
+	}
+}
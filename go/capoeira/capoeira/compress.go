@@ -0,0 +1,189 @@
+package capoeira
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codecs Compress can apply to payloads.
+const (
+	Gzip = "gzip"
+	Zstd = "zstd"
+)
+
+// DefaultMaxDecompressed is the most a payload may decompress to when Compression
+// doesn't say.
+const DefaultMaxDecompressed = 64 << 20
+
+// Compression configures which links Compress compresses payloads on, and with which codec.
+type Compression struct {
+	// Codec compresses payloads on links not in Links: Gzip, Zstd, or "" to leave them alone.
+	Codec string
+	// Links sets the codec of particular links, keyed "from->to". "" leaves a link alone.
+	Links map[string]string
+	// Threshold is the size of encoded payload below which payloads are sent as they are,
+	// as compressing small ones costs more than it saves.
+	Threshold int
+	// MaxDecompressed is the most a received payload may decompress to, in bytes;
+	// larger ones fail to receive. 0 uses DefaultMaxDecompressed.
+	MaxDecompressed int
+}
+
+func (c Compression) codec(from, to string) string {
+	if codec, ok := c.Links[from+"->"+to]; ok {
+		return codec
+	}
+	return c.Codec
+}
+
+// Compress is middleware that compresses payloads as configured by c. Receivers
+// decompress whatever codec the envelope names, up to c.MaxDecompressed. Put it before
+// Encrypt in a chain.
+func Compress(c Compression) Middleware {
+	d := newDecompressor(c.MaxDecompressed)
+	return Middleware{
+		Send: func(next SendFunc) SendFunc {
+			return func(ctx context.Context, env *Envelope) error {
+				codec := c.codec(env.From, env.To)
+				if codec == "" {
+					return next(ctx, env)
+				}
+				payload, err := env.Encode()
+				if err != nil {
+					return err
+				}
+				if len(payload) < c.Threshold {
+					return next(ctx, env)
+				}
+				compressed, err := compress(codec, payload)
+				if err != nil {
+					return err
+				}
+				env.PushEncoding(codec, compressed)
+				return next(ctx, env)
+			}
+		},
+		Receive: func(next ReceiveFunc) ReceiveFunc {
+			return func(ctx context.Context, from, at string) (*Envelope, error) {
+				env, err := next(ctx, from, at)
+				if err != nil {
+					return nil, err
+				}
+				encoding := env.Header[EncodingHeader]
+				codec := encoding[strings.LastIndex(encoding, ",")+1:]
+				if codec != Gzip && codec != Zstd {
+					return env, nil
+				}
+				compressed, err := env.PopEncoding(codec)
+				if err != nil {
+					return nil, err
+				}
+				if env.Payload, err = d.decompress(codec, compressed); err != nil {
+					return nil, fmt.Errorf("decompressing payload from %s: %w", from, err)
+				}
+				return env, nil
+			}
+		},
+	}
+}
+
+// CompressFromTopology returns Compress middleware compressing payloads on each link
+// with the first codec the receiving location lists that the sending one lists too.
+// Links between locations with no codec in common are left alone.
+func CompressFromTopology(t *Topology, threshold int) Middleware {
+	c := Compression{Links: make(map[string]string), Threshold: threshold}
+	for from, sender := range t.Locations {
+		for to, receiver := range t.Locations {
+			for _, codec := range receiver.Compression {
+				if slices.Contains(sender.Compression, codec) {
+					c.Links[from+"->"+to] = codec
+					break
+				}
+			}
+		}
+	}
+	return Compress(c)
+}
+
+// zstd encoders are costly to make, and safe to share for whole payloads.
+var zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) { return zstd.NewWriter(nil) })
+
+func compress(codec string, payload []byte) ([]byte, error) {
+	switch codec {
+	case Gzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(payload); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case Zstd:
+		enc, err := zstdEncoder()
+		if err != nil {
+			return nil, err
+		}
+		return enc.EncodeAll(payload, nil), nil
+	}
+	return nil, fmt.Errorf("unknown compression codec %q", codec)
+}
+
+// decompressor decompresses payloads up to a maximum size, so a small payload can't
+// expand to exhaust the receiver's memory.
+type decompressor struct {
+	max  int
+	zstd func() (*zstd.Decoder, error)
+}
+
+func newDecompressor(limit int) *decompressor {
+	if limit <= 0 {
+		limit = DefaultMaxDecompressed
+	}
+	return &decompressor{
+		max: limit,
+		zstd: sync.OnceValues(func() (*zstd.Decoder, error) {
+			return zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(limit)))
+		}),
+	}
+}
+
+func (d *decompressor) decompress(codec string, compressed []byte) ([]byte, error) {
+	switch codec {
+	case Gzip:
+		r, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		payload, err := io.ReadAll(io.LimitReader(r, int64(d.max)+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(payload) > d.max {
+			return nil, fmt.Errorf("payload larger than %d bytes", d.max)
+		}
+		return payload, nil
+	case Zstd:
+		dec, err := d.zstd()
+		if err != nil {
+			return nil, err
+		}
+		payload, err := dec.DecodeAll(compressed, nil)
+		if errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+			return nil, fmt.Errorf("payload larger than %d bytes", d.max)
+		}
+		return payload, err
+	}
+	return nil, fmt.Errorf("unknown compression codec %q", codec)
+}
@@ -0,0 +1,57 @@
+package capoeira
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestCompressShrinksLargePayloads(t *testing.T) {
+	large := strings.Repeat(`{"title":"TAPL","price":80}`, 200)
+	for _, codec := range []string{Gzip, Zstd} {
+		channels := NewChannelTransport([]string{Seller{}.Name(), Buyer{}.Name()})
+		transport := Chain(jsonTransport{channels}, Compress(Compression{
+			Links:     map[string]string{Seller{}.Name() + "->" + Buyer{}.Name(): codec},
+			Threshold: 256,
+		}))
+
+		for _, payload := range []string{large, "TAPL"} {
+			transport.Send(Seller{}.Name(), Buyer{}.Name(), payload)
+			raw := channels.Receive(Seller{}.Name(), Buyer{}.Name()).([]byte)
+			compressed := strings.Contains(string(raw), `"encoding":"json,`+codec+`"`)
+			if compressed != (payload == large) {
+				t.Errorf("%s: compressed a %d byte payload: %v", codec, len(payload), compressed)
+			}
+			if payload == large && len(raw) >= len(large)/4 {
+				t.Errorf("%s: expected a large payload to shrink, sent %d bytes", codec, len(raw))
+			}
+			channels.Send(Seller{}.Name(), Buyer{}.Name(), raw)
+			if got := transport.Receive(Seller{}.Name(), Buyer{}.Name()); got != payload {
+				t.Errorf("%s: expected the payload back, got %.40v", codec, got)
+			}
+		}
+	}
+}
+
+func TestCompressRefusesPayloadsOverMax(t *testing.T) {
+	bomb := strings.Repeat("a", 1<<20)
+	for _, codec := range []string{Gzip, Zstd} {
+		channels := NewChannelTransport([]string{Seller{}.Name(), Buyer{}.Name()})
+		transport := Chain(jsonTransport{channels}, Compress(Compression{Codec: codec, MaxDecompressed: 64 << 10}))
+
+		transport.Send(Seller{}.Name(), Buyer{}.Name(), bomb)
+		raw := channels.Receive(Seller{}.Name(), Buyer{}.Name()).([]byte)
+		if len(raw) >= 64<<10 {
+			t.Fatalf("%s: expected the payload to compress below the maximum, sent %d bytes", codec, len(raw))
+		}
+		channels.Send(Seller{}.Name(), Buyer{}.Name(), raw)
+		if _, _, err := transport.ReceiveContext(context.Background(), Seller{}.Name(), Buyer{}.Name()); err == nil || !strings.Contains(err.Error(), "larger than") {
+			t.Errorf("%s: expected a payload decompressing past the maximum to fail, got %v", codec, err)
+		}
+
+		transport.Send(Seller{}.Name(), Buyer{}.Name(), "TAPL")
+		if got := transport.Receive(Seller{}.Name(), Buyer{}.Name()); got != "TAPL" {
+			t.Errorf("%s: expected a small payload through, got %v", codec, got)
+		}
+	}
+}
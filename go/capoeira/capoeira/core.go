@@ -1,8 +1,21 @@
 package capoeira
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"slices"
+	"sync/atomic"
+	"time"
 
-// Location represents a participant in a choreography.
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Location represents a participant in a choreography. A location standing for one
+// instance of a role is named "Role/ID", and shares the role's projection.
 type Location interface {
 	Name() string
 }
@@ -11,6 +24,16 @@ type Location interface {
 type Located struct {
 	Value    interface{}
 	Location Location
+	// future is set when Value is still being received by CommAsync.
+	future *future
+}
+
+// Get returns the value, first waiting for it to arrive if it came from CommAsync.
+func (l Located) Get() interface{} {
+	if l.future != nil {
+		return l.future.wait()
+	}
+	return l.Value
 }
 
 // MultiplyLocated represents a value located at multiple locations.
@@ -34,25 +57,77 @@ func (ml *MultiplyLocated) Get(location Location) interface{} {
 type ChoreoOp interface {
 	Locally(location Location, computation func() interface{}) Located
 	Comm(sender, receiver Location, data Located) Located
+	// CommAsync is like Comm, but the receiver doesn't wait for the value until
+	// Get is called on the result, so independent messages can be in flight at once.
+	CommAsync(sender, receiver Location, data Located) Located
 	Broadcast(sender Location, data Located) interface{}
 	Multicast(sender Location, destinations []Location, data Located) MultiplyLocated
+	// CommStream sends an io.Reader at sender to receiver in chunks with flow control,
+	// for payloads too large to send whole. The receiver gets an io.ReadCloser.
+	CommStream(sender, receiver Location, data Located) Located
+	// Cond sends the branch value at sender only to the involved locations and runs
+	// branch there with an op scoped to them. Other locations skip the branch and get nil.
+	Cond(sender Location, involved []Location, data Located, branch func(op ChoreoOp, choice interface{}) interface{}) interface{}
+	// Loop broadcasts the collection at sender and runs body once per element at every
+	// location, returning each iteration's result.
+	Loop(sender Location, items Located, body LoopBody) []interface{}
+	// WithTimeout returns an op whose operations each wait at most d for a peer
+	// before aborting the run with a *TimeoutError.
+	WithTimeout(d time.Duration) ChoreoOp
 }
 
+// LoopBody runs one iteration of ChoreoOp.Loop. Besides its result, it returns an
+// exit decision: a bool located somewhere that, when true, stops the loop at every
+// location after this iteration. Returning the zero Located keeps the loop going.
+type LoopBody func(op ChoreoOp, item interface{}) (result interface{}, exit Located)
+
 // Choreography is an interface for choreography logic.
 type Choreography interface {
 	Run(op ChoreoOp) interface{}
 }
 
+// Participants is implemented by choreographies that only involve some of the
+// transport's locations, such as one instance of a role among many. Broadcast in a
+// run of such a choreography reaches only its participants.
+type Participants interface {
+	Participants() []Location
+}
+
 // Projector performs end-point projection and runs a choreography.
 type Projector struct {
 	Target    Location
 	Transport Transport
+	// Logger traces each operation at debug level; nil uses DefaultLogger.
+	Logger *slog.Logger
+	// Session optionally identifies the run in logs, and ties the traces of
+	// endpoints in different processes together.
+	Session string
+	// TracerProvider records a span per run and per communication; nil uses the global provider.
+	TracerProvider trace.TracerProvider
+	// Timeout, if set, bounds the whole run, and OpTimeout each operation waiting on a
+	// peer. A run past either deadline aborts with a *TimeoutError and tells its peers,
+	// which abort with a *PeerAbortError rather than wait for it. Only transports
+	// implementing ContextTransport can be given up on.
+	Timeout   time.Duration
+	OpTimeout time.Duration
+	// Journal, if set, records the run's progress so running it again after a crash
+	// resumes where it stopped. Give the resumed run the same Session, so messages
+	// the crashed run may have sent are recognized by HTTPTransport as duplicates.
+	Journal Journal
+	// A run of a registered choreography starts by announcing the choreography, its
+	// version and the transport's codec to every peer, and fails with a *HandshakeError
+	// if any announces something else. Handshake does the same for choreographies that
+	// aren't registered, and SkipHandshake leaves it out. Every endpoint of a run must
+	// agree on whether to shake hands, so upgrade both sides of a link together.
+	Handshake     bool
+	SkipHandshake bool
 }
 
 func NewProjector(target Location, transport Transport) *Projector {
 	return &Projector{
 		Target:    target,
 		Transport: transport,
+		Logger:    DefaultLogger(),
 	}
 }
 
@@ -68,89 +143,411 @@ func (p *Projector) Remote(location Location) Located {
 type ProjectorChoreoOp struct {
 	Target    Location
 	Transport Transport
+	// members limits Broadcast to the locations of the run's membership view or an
+	// enclosing Cond; nil means every location.
+	members []string
+	// pending orders receives behind outstanding CommAsync calls from the same sender.
+	pending *pendingReceives
+	logger  *slog.Logger
+	// seq numbers the operations of a run, shared by every scope within it.
+	seq     *atomic.Uint64
+	ctx     context.Context
+	tracer  trace.Tracer
+	journal Journal
+	// timeout bounds each operation waiting on a peer; 0 means no bound but the run's.
+	timeout time.Duration
+}
+
+// next returns the sequence number of the operation being started.
+func (op ProjectorChoreoOp) next() uint64 {
+	if op.seq == nil {
+		return 0
+	}
+	return op.seq.Add(1)
+}
+
+// debug logs a step of an operation at debug level.
+func (op ProjectorChoreoOp) debug(msg, name string, seq uint64, peer string, args ...any) {
+	if op.logger == nil {
+		return
+	}
+	op.logger.Debug(msg, append([]any{"op", name, "seq", seq, "peer", peer}, args...)...)
+}
+
+func (op ProjectorChoreoOp) context() context.Context {
+	if op.ctx == nil {
+		return context.Background()
+	}
+	return op.ctx
+}
+
+// locations returns the names of the locations that take part at this point of the choreography.
+func (op ProjectorChoreoOp) locations() []string {
+	if op.members != nil {
+		return op.members
+	}
+	return op.Transport.Locations()
+}
+
+// send sends data from the target to another location, passing ctx along if the transport carries it.
+// A send the journal has recorded was made before a crash, and isn't made again.
+func (op ProjectorChoreoOp) send(ctx context.Context, seq uint64, to string, data interface{}) {
+	if op.pending != nil {
+		// a stream from the peer takes the way back for its credits until it's done
+		op.pending.waitStream(to)
+	}
+	if _, done := op.lookup(seq, to); done {
+		op.debug("replayed", "send", seq, to)
+		return
+	}
+	t, ok := op.Transport.(ContextTransport)
+	if !ok {
+		op.Transport.Send(op.Target.Name(), to, data)
+		op.record(seq, to, nil)
+		return
+	}
+	if session := SessionFromContext(ctx); op.journal != nil && session != "" {
+		// the same message from a resumed run has the same ID
+		ctx = WithMessageID(ctx, fmt.Sprintf("%s/%s->%s/%d", session, op.Target.Name(), to, seq))
+	}
+	ctx, cancel := op.withDeadline(ctx)
+	defer cancel()
+	if err := t.SendContext(ctx, op.Target.Name(), to, data); err != nil {
+		op.fail(ctx, seq, to, err)
+	}
+	op.record(seq, to, nil)
+}
+
+// receive waits for any outstanding async receives from sender, then receives the next value from it.
+// The sender's span, if it propagated one, is linked to the span in ctx. A value the
+// journal has recorded was received before a crash, and is returned from there.
+func (op ProjectorChoreoOp) receive(ctx context.Context, seq uint64, sender string) interface{} {
+	if val, ok := op.lookup(seq, sender); ok {
+		op.debug("replayed", "receive", seq, sender, "data", val)
+		return val
+	}
+	if op.pending != nil {
+		op.pending.wait(sender)
+	}
+	t, ok := op.Transport.(ContextTransport)
+	if !ok {
+		val := op.Transport.Receive(sender, op.Target.Name())
+		op.record(seq, sender, val)
+		return val
+	}
+	wctx, cancel := op.withDeadline(ctx)
+	defer cancel()
+	val, remote, err := t.ReceiveContext(wctx, sender, op.Target.Name())
+	for err == nil {
+		reason, session, ok := abortNotice(val)
+		if !ok {
+			break
+		}
+		if session == SessionFromContext(ctx) {
+			panic(runAbort{&PeerAbortError{Location: op.Target.Name(), Peer: sender, Reason: reason}})
+		}
+		// a run of another session on the same link gave up, not this one
+		op.debug("ignored abort notice", "receive", seq, sender, "session", session)
+		val, remote, err = t.ReceiveContext(wctx, sender, op.Target.Name())
+	}
+	if err != nil {
+		op.fail(wctx, seq, sender, err)
+	}
+	op.record(seq, sender, val)
+	if remote != nil {
+		if sc := trace.SpanContextFromContext(remote); sc.IsValid() && !sc.Equal(trace.SpanContextFromContext(ctx)) {
+			trace.SpanFromContext(ctx).AddLink(trace.Link{SpanContext: sc})
+		}
+	}
+	return val
+}
+
+// lookup returns what the journal recorded for an operation, if there is a journal.
+func (op ProjectorChoreoOp) lookup(seq uint64, peer string) (interface{}, bool) {
+	if op.journal == nil {
+		return nil, false
+	}
+	return op.journal.Lookup(SessionFromContext(op.context()), seq, peer)
+}
+
+// record records a completed operation in the journal, if there is one, aborting the
+// run if it can't: a resumed run would repeat the operation.
+func (op ProjectorChoreoOp) record(seq uint64, peer string, value interface{}) {
+	if op.journal == nil {
+		return
+	}
+	if err := op.journal.Record(SessionFromContext(op.context()), seq, peer, value); err != nil {
+		panic(runAbort{fmt.Errorf("capoeira: %s failed to journal op %d: %w", op.Target.Name(), seq, err)})
+	}
 }
 
 func (op ProjectorChoreoOp) Locally(location Location, computation func() interface{}) Located {
+	seq := op.next()
 	if location.Name() == op.Target.Name() {
-		return Located{Value: computation(), Location: location}
+		if val, ok := op.lookup(seq, ""); ok {
+			op.debug("replayed", "locally", seq, "", "data", val)
+			return Located{Value: val, Location: location}
+		}
+		val := computation()
+		op.record(seq, "", val)
+		return Located{Value: val, Location: location}
 	}
 	return Located{Value: nil, Location: location}
 }
 
 func (op ProjectorChoreoOp) Comm(sender, receiver Location, data Located) Located {
+	seq := op.next()
 	if sender.Name() == op.Target.Name() && sender.Name() == receiver.Name() {
-		return Located{Value: data.Value, Location: receiver}
+		return Located{Value: data.Get(), Location: receiver}
 	}
 	if sender.Name() == op.Target.Name() {
 		// Send via transport
-		if t, ok := op.Transport.(Transport); ok {
-			fmt.Printf("Sending from %s to %s. data: %+v\n", sender.Name(), receiver.Name(), data.Value)
-			t.Send(sender.Name(), receiver.Name(), data.Value)
-		}
-		return Located{Value: data.Value, Location: receiver}
+		ctx, span := op.span("Comm", seq, receiver.Name())
+		defer span.End()
+		op.debug("sending", "comm", seq, receiver.Name(), "data", data.Get())
+		op.send(ctx, seq, receiver.Name(), data.Get())
+		return Located{Value: data.Get(), Location: receiver}
 	} else if receiver.Name() == op.Target.Name() {
 		// Receive via transport
-		if t, ok := op.Transport.(Transport); ok {
-			fmt.Printf("Receiving from %s at %s\n", sender.Name(), receiver.Name())
-			val := t.Receive(sender.Name(), receiver.Name())
-			fmt.Printf("Received val: %+v\n", val)
-			return Located{Value: val, Location: receiver}
-		}
-		return Located{Value: nil, Location: receiver}
+		ctx, span := op.span("Comm", seq, sender.Name())
+		defer span.End()
+		op.debug("receiving", "comm", seq, sender.Name())
+		val := op.receive(ctx, seq, sender.Name())
+		op.debug("received", "comm", seq, sender.Name(), "data", val)
+		return Located{Value: val, Location: receiver}
 	}
 	return Located{Value: nil, Location: receiver}
 }
 
+func (op ProjectorChoreoOp) CommAsync(sender, receiver Location, data Located) Located {
+	if receiver.Name() != op.Target.Name() || sender.Name() == receiver.Name() || op.pending == nil {
+		return op.Comm(sender, receiver, data)
+	}
+	seq := op.next()
+	ctx, span := op.span("CommAsync", seq, sender.Name())
+	f := newFuture()
+	waitPrev := op.pending.push(sender.Name(), f)
+	op.debug("receiving", "comm_async", seq, sender.Name())
+	go func() {
+		defer span.End()
+		defer func() {
+			// an aborted receive aborts the run where the value is waited for
+			if r := recover(); r != nil {
+				a, ok := r.(runAbort)
+				if !ok {
+					panic(r)
+				}
+				f.abort(a)
+			}
+		}()
+		waitPrev()
+		// the pending receives were just waited for, so receive without waiting on f itself
+		scoped := op
+		scoped.pending = nil
+		val := scoped.receive(ctx, seq, sender.Name())
+		op.debug("received", "comm_async", seq, sender.Name(), "data", val)
+		f.resolve(val)
+	}()
+	return Located{Location: receiver, future: f}
+}
+
 func (op ProjectorChoreoOp) Broadcast(sender Location, data Located) interface{} {
+	seq := op.next()
 	if sender.Name() == op.Target.Name() {
-		if t, ok := op.Transport.(Transport); ok {
-			for _, dest := range t.Locations() {
-				if dest != sender.Name() {
-					t.Send(sender.Name(), dest, data.Value)
-				}
+		ctx, span := op.span("Broadcast", seq, op.locations()...)
+		defer span.End()
+		for _, dest := range op.locations() {
+			if dest != sender.Name() {
+				op.debug("sending", "broadcast", seq, dest, "data", data.Get())
+				op.send(ctx, seq, dest, data.Get())
 			}
 		}
-		return data.Value
-	}
-	if t, ok := op.Transport.(Transport); ok {
-		return t.Receive(sender.Name(), op.Target.Name())
+		return data.Get()
 	}
-	return data.Value
+	ctx, span := op.span("Broadcast", seq, sender.Name())
+	defer span.End()
+	op.debug("receiving", "broadcast", seq, sender.Name())
+	val := op.receive(ctx, seq, sender.Name())
+	op.debug("received", "broadcast", seq, sender.Name(), "data", val)
+	return val
 }
 
 func (op ProjectorChoreoOp) Multicast(sender Location, destinations []Location, data Located) MultiplyLocated {
+	seq := op.next()
 	ml := NewMultiplyLocated()
 	if sender.Name() == op.Target.Name() {
-		if t, ok := op.Transport.(Transport); ok {
-			for _, dest := range destinations {
-				if dest.Name() != sender.Name() {
-					t.Send(sender.Name(), dest.Name(), data.Value)
-				}
+		names := make([]string, 0, len(destinations))
+		for _, dest := range destinations {
+			names = append(names, dest.Name())
+		}
+		ctx, span := op.span("Multicast", seq, names...)
+		defer span.End()
+		for _, dest := range destinations {
+			if dest.Name() != sender.Name() {
+				op.debug("sending", "multicast", seq, dest.Name(), "data", data.Get())
+				op.send(ctx, seq, dest.Name(), data.Get())
 			}
 		}
 		for _, dest := range destinations {
-			ml.Add(dest, data.Value)
+			ml.Add(dest, data.Get())
 		}
 	} else {
-		if t, ok := op.Transport.(Transport); ok {
-			for _, dest := range destinations {
-				if dest.Name() == op.Target.Name() {
-					val := t.Receive(sender.Name(), dest.Name())
-					ml.Add(dest, val)
-				} else {
-					ml.Add(dest, nil)
-				}
+		ctx, span := op.span("Multicast", seq, sender.Name())
+		defer span.End()
+		for _, dest := range destinations {
+			if dest.Name() == op.Target.Name() {
+				op.debug("receiving", "multicast", seq, sender.Name())
+				val := op.receive(ctx, seq, sender.Name())
+				op.debug("received", "multicast", seq, sender.Name(), "data", val)
+				ml.Add(dest, val)
+			} else {
+				ml.Add(dest, nil)
 			}
 		}
 	}
 	return ml
 }
 
+func (op ProjectorChoreoOp) Cond(sender Location, involved []Location, data Located, branch func(op ChoreoOp, choice interface{}) interface{}) interface{} {
+	seq := op.next()
+	members := []string{sender.Name()}
+	for _, loc := range involved {
+		if !slices.Contains(members, loc.Name()) {
+			members = append(members, loc.Name())
+		}
+	}
+	if !slices.Contains(members, op.Target.Name()) {
+		return nil
+	}
+	ctx, span := op.span("Cond", seq, members...)
+	defer span.End()
+	var choice interface{}
+	if sender.Name() == op.Target.Name() {
+		for _, dest := range members[1:] {
+			op.debug("sending", "cond", seq, dest, "data", data.Get())
+			op.send(ctx, seq, dest, data.Get())
+		}
+		choice = data.Get()
+	} else {
+		op.debug("receiving", "cond", seq, sender.Name())
+		choice = op.receive(ctx, seq, sender.Name())
+		op.debug("received", "cond", seq, sender.Name(), "data", choice)
+	}
+	scoped := op
+	scoped.members = members
+	scoped.ctx = ctx
+	return branch(scoped, choice)
+}
+
+func (op ProjectorChoreoOp) Loop(sender Location, items Located, body LoopBody) []interface{} {
+	collection := reflect.ValueOf(op.Broadcast(sender, items))
+	if !collection.IsValid() {
+		return nil
+	}
+	if collection.Kind() != reflect.Slice && collection.Kind() != reflect.Array {
+		panic(fmt.Sprintf("capoeira: Loop over %T, expected a slice or array", collection.Interface()))
+	}
+	results := make([]interface{}, 0, collection.Len())
+	for i := 0; i < collection.Len(); i++ {
+		// each iteration gets its own scope, and doesn't finish until its messages have arrived
+		iteration := op
+		if op.pending != nil {
+			iteration.pending = newPendingReceives(op.pending)
+		}
+		result, exit := body(iteration, collection.Index(i).Interface())
+		if iteration.pending != nil {
+			iteration.pending.waitAll()
+		}
+		results = append(results, result)
+		if exit.Location != nil {
+			if stop, _ := iteration.Broadcast(exit.Location, exit).(bool); stop {
+				break
+			}
+		}
+	}
+	return results
+}
+
+func (op ProjectorChoreoOp) WithTimeout(d time.Duration) ChoreoOp {
+	op.timeout = d
+	return op
+}
+
 // EppAndRun performs end-point projection to run a choreography for the target location.
+// If the run is aborted, the error is logged and the result is nil.
 func (p *Projector) EppAndRun(choreo Choreography) interface{} {
+	result, _ := p.EppAndRunContext(context.Background(), choreo)
+	return result
+}
+
+// EppAndRunContext is like EppAndRun, recording the run as a span under ctx and
+// returning why the run was aborted, if it was: a *TimeoutError, a *PeerAbortError,
+// the cancellation of ctx or a transport's error.
+func (p *Projector) EppAndRunContext(ctx context.Context, choreo Choreography) (result interface{}, err error) {
+	logger := p.Logger
+	if logger == nil {
+		logger = DefaultLogger()
+	}
+	logger = logger.With("location", p.Target.Name())
+	if p.Session != "" {
+		logger = logger.With("session", p.Session)
+		ctx = WithSession(ctx, p.Session)
+	}
+	tracer := tracer(p.TracerProvider)
+	ctx, span := tracer.Start(sessionTrace(ctx, p.Session), "capoeira.EppAndRun", trace.WithAttributes(
+		attribute.String("capoeira.location", p.Target.Name()),
+		attribute.String("capoeira.choreography", fmt.Sprintf("%T", choreo)),
+		attribute.String("capoeira.session", p.Session),
+	))
+	defer span.End()
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
 	op := ProjectorChoreoOp{
 		Target:    p.Target,
 		Transport: p.Transport,
+		pending:   newPendingReceives(nil),
+		logger:    logger,
+		seq:       new(atomic.Uint64),
+		ctx:       ctx,
+		tracer:    tracer,
+		journal:   p.Journal,
+		timeout:   p.OpTimeout,
+	}
+	if m := membershipOf(p.Transport); m != nil {
+		view, leave := m.Join(p.Session)
+		defer leave()
+		op.members = view.Locations
+		span.SetAttributes(attribute.Int64("capoeira.membership", int64(view.Version)))
+	}
+	if c, ok := choreo.(Participants); ok {
+		op.members = nil
+		for _, loc := range c.Participants() {
+			op.members = append(op.members, loc.Name())
+		}
+	}
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		a, ok := r.(runAbort)
+		if !ok {
+			panic(r)
+		}
+		result, err = nil, a.err
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "aborted")
+		logger.Error("run aborted", "err", err)
+		if _, mismatch := err.(*HandshakeError); !mismatch {
+			// peers that shook hands find the mismatch themselves
+			op.abortPeers(err)
+		}
+	}()
+	if _, registered := registeredInfo(choreo); (registered || p.Handshake) && !p.SkipHandshake {
+		op.shakeHands(handshakeFor(choreo, p.Transport))
 	}
-	return choreo.Run(op)
+	return choreo.Run(op), nil
 }
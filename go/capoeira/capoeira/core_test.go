@@ -0,0 +1,133 @@
+package capoeira
+
+import (
+	"sync"
+	"testing"
+)
+
+// countingTransport records how many messages each location was sent.
+type countingTransport struct {
+	Transport
+	lock sync.Mutex
+	sent map[string]int
+}
+
+func (t *countingTransport) Send(from, to string, data interface{}) {
+	t.lock.Lock()
+	t.sent[to]++
+	t.lock.Unlock()
+	t.Transport.Send(from, to, data)
+}
+
+// runAll runs choreo at every location and returns the results by location name.
+func runAll(transport Transport, choreo Choreography, locations ...Location) map[string]interface{} {
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	results := make(map[string]interface{})
+	for _, loc := range locations {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := NewProjector(loc, transport).EppAndRun(choreo)
+			lock.Lock()
+			results[loc.Name()] = res
+			lock.Unlock()
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+type condChoreography struct{}
+
+func (condChoreography) Run(op ChoreoOp) interface{} {
+	decision := op.Locally(ParkingAuthority{}, func() interface{} { return true })
+	return op.Cond(ParkingAuthority{}, []Location{Printer{}}, decision, func(op ChoreoOp, choice interface{}) interface{} {
+		// scoped to the involved locations, so this doesn't reach the ticketer either
+		return op.Broadcast(ParkingAuthority{}, Located{Value: "ticket", Location: ParkingAuthority{}})
+	})
+}
+
+func TestCondOnlyReachesInvolvedLocations(t *testing.T) {
+	transport := &countingTransport{
+		Transport: NewChannelTransport([]string{Ticketer{}.Name(), ParkingAuthority{}.Name(), Printer{}.Name()}),
+		sent:      make(map[string]int),
+	}
+	results := runAll(transport, condChoreography{}, Ticketer{}, ParkingAuthority{}, Printer{})
+
+	if results[Ticketer{}.Name()] != nil {
+		t.Errorf("expected nil at uninvolved ticketer, got %v", results[Ticketer{}.Name()])
+	}
+	for _, loc := range []string{ParkingAuthority{}.Name(), Printer{}.Name()} {
+		if results[loc] != "ticket" {
+			t.Errorf("expected ticket at %s, got %v", loc, results[loc])
+		}
+	}
+	if n := transport.sent[Ticketer{}.Name()]; n != 0 {
+		t.Errorf("expected no messages to ticketer, got %d", n)
+	}
+	if n := transport.sent[Printer{}.Name()]; n != 2 {
+		t.Errorf("expected 2 messages to printer, got %d", n)
+	}
+}
+
+type asyncChoreography struct{}
+
+func (asyncChoreography) Run(op ChoreoOp) interface{} {
+	first := op.CommAsync(ParkingAuthority{}, Printer{}, op.Locally(ParkingAuthority{}, func() interface{} { return 1 }))
+	second := op.CommAsync(Ticketer{}, Printer{}, op.Locally(Ticketer{}, func() interface{} { return 2 }))
+	third := op.CommAsync(ParkingAuthority{}, Printer{}, op.Locally(ParkingAuthority{}, func() interface{} { return 3 }))
+	fourth := op.Comm(ParkingAuthority{}, Printer{}, op.Locally(ParkingAuthority{}, func() interface{} { return 4 }))
+	return op.Locally(Printer{}, func() interface{} {
+		return []interface{}{third.Get(), second.Get(), first.Get(), fourth.Value}
+	}).Value
+}
+
+func TestCommAsyncKeepsSenderOrder(t *testing.T) {
+	transport := NewChannelTransport([]string{Ticketer{}.Name(), ParkingAuthority{}.Name(), Printer{}.Name()})
+	results := runAll(transport, asyncChoreography{}, Ticketer{}, ParkingAuthority{}, Printer{})
+
+	got, _ := results[Printer{}.Name()].([]interface{})
+	want := []interface{}{3, 2, 1, 4}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v at printer, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("expected %v at printer, got %v", want, got)
+			break
+		}
+	}
+}
+
+type loopChoreography struct{}
+
+func (loopChoreography) Run(op ChoreoOp) interface{} {
+	items := op.Locally(Ticketer{}, func() interface{} { return []int{1, 2, 3, 4, 5} })
+	return op.Loop(Ticketer{}, items, func(op ChoreoOp, item interface{}) (interface{}, Located) {
+		doubled := op.CommAsync(ParkingAuthority{}, Printer{}, op.Locally(ParkingAuthority{}, func() interface{} {
+			return item.(int) * 2
+		}))
+		exit := op.Locally(ParkingAuthority{}, func() interface{} { return item.(int) == 3 })
+		return doubled.Get(), exit
+	})
+}
+
+func TestLoopStopsEverywhereOnExit(t *testing.T) {
+	transport := NewChannelTransport([]string{Ticketer{}.Name(), ParkingAuthority{}.Name(), Printer{}.Name()})
+	results := runAll(transport, loopChoreography{}, Ticketer{}, ParkingAuthority{}, Printer{})
+
+	for loc, res := range results {
+		iterations, _ := res.([]interface{})
+		if len(iterations) != 3 {
+			t.Errorf("expected 3 iterations at %s, got %v", loc, res)
+		}
+	}
+	got := results[Printer{}.Name()].([]interface{})
+	for i, want := range []interface{}{2, 4, 6} {
+		if got[i] != want {
+			t.Errorf("expected %v at printer, got %v", []interface{}{2, 4, 6}, got)
+			break
+		}
+	}
+}
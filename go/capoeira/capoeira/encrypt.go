@@ -0,0 +1,167 @@
+package capoeira
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+)
+
+// encryptionName is the encoding Encrypt adds to an envelope's payload.
+const encryptionName = "x25519-aes256gcm"
+
+// Encrypt is middleware that encrypts payloads on every link between two locations
+// with keys in public, decrypting with the keys in private. A link missing a key
+// fails unless WithPlaintextLink allows it. There is no replay protection within a
+// session.
+func Encrypt(private map[string]*ecdh.PrivateKey, public map[string]*ecdh.PublicKey, opts ...MiddlewareOption) Middleware {
+	config := newMiddlewareConfig(opts)
+	logger := config.logger
+	links := &linkCiphers{private: private, public: public, plaintext: config.plaintext, ciphers: make(map[string]cipher.AEAD)}
+	return Middleware{
+		Send: func(next SendFunc) SendFunc {
+			return func(ctx context.Context, env *Envelope) error {
+				if encrypted, err := links.encrypted(env.From, env.To); err != nil {
+					return err
+				} else if !encrypted {
+					return next(ctx, env)
+				}
+				aead, err := links.cipher(env.From, env.To, env.From)
+				if err != nil {
+					return err
+				}
+				payload, err := env.Encode()
+				if err != nil {
+					return err
+				}
+				nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(payload)+aead.Overhead())
+				if _, err := rand.Read(nonce); err != nil {
+					return fmt.Errorf("generating nonce: %w", err)
+				}
+				env.PushEncoding(encryptionName, aead.Seal(nonce, nonce, payload, signed(env, nil)))
+				return next(ctx, env)
+			}
+		},
+		Receive: func(next ReceiveFunc) ReceiveFunc {
+			return func(ctx context.Context, from, at string) (*Envelope, error) {
+				if encrypted, err := links.encrypted(from, at); err != nil {
+					return nil, err
+				} else if !encrypted {
+					return next(ctx, from, at)
+				}
+				aead, err := links.cipher(from, at, at)
+				if err != nil {
+					return nil, err
+				}
+				env, err := next(ctx, from, at)
+				if err != nil {
+					return nil, err
+				}
+				if err := decrypt(aead, env, from, at); err != nil {
+					logger.Warn("undecryptable message", "location", at, "peer", from, "err", err)
+					return nil, fmt.Errorf("decrypting message from %s: %w", from, err)
+				}
+				return env, nil
+			}
+		},
+	}
+}
+
+// EncryptFromTopology returns Encrypt middleware for the given local locations, with
+// keys from the topology.
+func EncryptFromTopology(t *Topology, local []string, opts ...MiddlewareOption) (Middleware, error) {
+	private, err := t.DecryptionKeys(local...)
+	if err != nil {
+		return Middleware{}, err
+	}
+	public, err := t.EncryptionKeys()
+	if err != nil {
+		return Middleware{}, err
+	}
+	return Encrypt(private, public, opts...), nil
+}
+
+func decrypt(aead cipher.AEAD, env *Envelope, from, at string) error {
+	if env.From != from || env.To != at {
+		return fmt.Errorf("envelope addressed %s->%s", env.From, env.To)
+	}
+	sealed, err := env.PopEncoding(encryptionName)
+	if err != nil {
+		return err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return fmt.Errorf("payload too short")
+	}
+	payload, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], signed(env, nil))
+	if err != nil {
+		return err
+	}
+	env.Payload = payload
+	return nil
+}
+
+// linkCiphers derives and caches the cipher of each encrypted link.
+type linkCiphers struct {
+	private   map[string]*ecdh.PrivateKey
+	public    map[string]*ecdh.PublicKey
+	plaintext map[string]bool
+	lock      sync.Mutex
+	ciphers   map[string]cipher.AEAD
+}
+
+// encrypted reports whether the link from->to is encrypted, failing if it lacks a key
+// and isn't allowed in the clear.
+func (l *linkCiphers) encrypted(from, to string) (bool, error) {
+	if l.public[from] != nil && l.public[to] != nil {
+		return true, nil
+	}
+	if l.plaintext[from+"->"+to] {
+		return false, nil
+	}
+	missing := from
+	if l.public[from] != nil {
+		missing = to
+	}
+	return false, fmt.Errorf("no encryption key for %s on link %s->%s", missing, from, to)
+}
+
+// cipher returns the cipher of the link from->to, as seen at the local end.
+func (l *linkCiphers) cipher(from, to, local string) (cipher.AEAD, error) {
+	link := from + "->" + to
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if aead, ok := l.ciphers[link]; ok {
+		return aead, nil
+	}
+	remote := from
+	if local == from {
+		remote = to
+	}
+	key, ok := l.private[local]
+	if !ok {
+		return nil, fmt.Errorf("no decryption key for %s", local)
+	}
+	shared, err := key.ECDH(l.public[remote])
+	if err != nil {
+		return nil, err
+	}
+	secret, err := hkdf.Key(sha256.New, shared, nil, "capoeira "+link, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	l.ciphers[link] = aead
+	return aead, nil
+}
@@ -0,0 +1,67 @@
+package capoeira
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"testing"
+)
+
+// encryptionKeys generates a key pair for each location.
+func encryptionKeys(t *testing.T, locations ...string) (map[string]*ecdh.PrivateKey, map[string]*ecdh.PublicKey) {
+	private := make(map[string]*ecdh.PrivateKey)
+	public := make(map[string]*ecdh.PublicKey)
+	for _, name := range locations {
+		key, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		private[name], public[name] = key, key.PublicKey()
+	}
+	return private, public
+}
+
+func TestEncryptHidesPayloadFromTransport(t *testing.T) {
+	private, public := encryptionKeys(t, Seller{}.Name(), Buyer{}.Name())
+	channels := NewChannelTransport([]string{Seller{}.Name(), Buyer{}.Name()})
+	transport := Chain(jsonTransport{channels}, Encrypt(private, public))
+
+	transport.Send(Seller{}.Name(), Buyer{}.Name(), "patient record")
+	raw := channels.Receive(Seller{}.Name(), Buyer{}.Name()).([]byte)
+	if bytes.Contains(raw, []byte("patient")) {
+		t.Fatalf("payload sent in clear: %s", raw)
+	}
+	channels.Send(Seller{}.Name(), Buyer{}.Name(), raw)
+	if got := transport.Receive(Seller{}.Name(), Buyer{}.Name()); got != "patient record" {
+		t.Errorf("expected the decrypted payload, got %v", got)
+	}
+
+	Chain(jsonTransport{channels}).Send(Seller{}.Name(), Buyer{}.Name(), "forged record")
+	if _, _, err := transport.ReceiveContext(context.Background(), Seller{}.Name(), Buyer{}.Name()); err == nil {
+		t.Errorf("expected an unencrypted payload to fail")
+	}
+}
+
+func TestEncryptRefusesLinksWithoutKeys(t *testing.T) {
+	// the printer has no key
+	private, public := encryptionKeys(t, Seller{}.Name(), Buyer{}.Name())
+	channels := NewChannelTransport([]string{Seller{}.Name(), Buyer{}.Name(), Printer{}.Name()})
+	ctx := context.Background()
+
+	strict := Chain(jsonTransport{channels}, Encrypt(private, public))
+	if err := strict.SendContext(ctx, Seller{}.Name(), Printer{}.Name(), "patient record"); err == nil {
+		t.Errorf("expected a send to a location without a key to fail")
+	}
+
+	lenient := Chain(jsonTransport{channels}, Encrypt(private, public, WithPlaintextLink(Printer{}.Name(), Seller{}.Name())))
+	if err := lenient.SendContext(ctx, Seller{}.Name(), Printer{}.Name(), "label"); err != nil {
+		t.Fatalf("expected the allowed link to send in the clear, got %v", err)
+	}
+	if got, _, err := lenient.ReceiveContext(ctx, Seller{}.Name(), Printer{}.Name()); err != nil || got != "label" {
+		t.Errorf("expected the plaintext message, got %v (%v)", got, err)
+	}
+	if err := lenient.SendContext(ctx, Buyer{}.Name(), Printer{}.Name(), "patient record"); err == nil {
+		t.Errorf("expected a link that wasn't allowed to still fail")
+	}
+}
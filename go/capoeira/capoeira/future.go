@@ -0,0 +1,114 @@
+package capoeira
+
+import "sync"
+
+// future is a value that is filled in once by a background receive.
+type future struct {
+	done  chan struct{}
+	value interface{}
+	// aborted is set if the receive aborted the run, to abort it again where the value is waited for.
+	aborted *runAbort
+}
+
+func newFuture() *future {
+	return &future{done: make(chan struct{})}
+}
+
+func (f *future) resolve(value interface{}) {
+	f.value = value
+	close(f.done)
+}
+
+func (f *future) abort(a runAbort) {
+	f.aborted = &a
+	close(f.done)
+}
+
+// wait blocks until the future is resolved and returns its value.
+func (f *future) wait() interface{} {
+	<-f.done
+	if f.aborted != nil {
+		panic(*f.aborted)
+	}
+	return f.value
+}
+
+// pendingReceives tracks the latest outstanding async receive from each sender,
+// so later receives from the same sender are delivered in choreography order.
+type pendingReceives struct {
+	lock   sync.Mutex
+	latest map[string]*future
+	// streams are the latest streams from each sender, which sends to it wait for.
+	streams map[string]*future
+	// parent is the enclosing scope, e.g. the run around a loop iteration.
+	parent *pendingReceives
+}
+
+func newPendingReceives(parent *pendingReceives) *pendingReceives {
+	return &pendingReceives{latest: make(map[string]*future), streams: make(map[string]*future), parent: parent}
+}
+
+// push records f as the latest receive from sender and returns a func that waits
+// for the receives from sender issued before it.
+func (p *pendingReceives) push(sender string, f *future) func() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.pushLocked(sender, f)
+}
+
+// pushStream is like push for a stream from sender, which sends to sender also wait for.
+func (p *pendingReceives) pushStream(sender string, f *future) func() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.streams[sender] = f
+	return p.pushLocked(sender, f)
+}
+
+func (p *pendingReceives) pushLocked(sender string, f *future) func() {
+	prev := p.latest[sender]
+	p.latest[sender] = f
+	return func() {
+		if prev != nil {
+			prev.wait()
+		} else if p.parent != nil {
+			p.parent.wait(sender)
+		}
+	}
+}
+
+// wait blocks until every async receive from sender issued so far has completed.
+func (p *pendingReceives) wait(sender string) {
+	p.lock.Lock()
+	f := p.latest[sender]
+	p.lock.Unlock()
+	if f != nil {
+		f.wait()
+	} else if p.parent != nil {
+		p.parent.wait(sender)
+	}
+}
+
+// waitStream blocks until every stream from peer received so far is done.
+func (p *pendingReceives) waitStream(peer string) {
+	p.lock.Lock()
+	f := p.streams[peer]
+	p.lock.Unlock()
+	if f != nil {
+		f.wait()
+	} else if p.parent != nil {
+		p.parent.waitStream(peer)
+	}
+}
+
+// waitAll blocks until every async receive issued in this scope has completed.
+func (p *pendingReceives) waitAll() {
+	p.lock.Lock()
+	fs := make([]*future, 0, len(p.latest))
+	for _, f := range p.latest {
+		fs = append(fs, f)
+	}
+	p.lock.Unlock()
+	for _, f := range fs {
+		f.wait()
+	}
+}
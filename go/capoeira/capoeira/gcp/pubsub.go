@@ -2,85 +2,200 @@ package gcp
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
-	"os"
-	"sync"
+	"log/slog"
+	"net/url"
+	"slices"
+	"time"
 
 	pubsub "cloud.google.com/go/pubsub/v2"
+	"cloud.google.com/go/pubsub/v2/apiv1/pubsubpb"
+	"github.com/danielc-lh/scripts/capoeira"
+	"go.opentelemetry.io/otel/propagation"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// PubSubTransport carries messages through Pub/Sub: each location has a topic, and
+// receives from each peer through an ordered subscription to it filtered by sender.
 type PubSubTransport struct {
-	projectID     string
-	topics        map[string]*pubsub.Topic
-	subscriptions map[string]*pubsub.Subscription
-	client        *pubsub.Client
-	lock          sync.RWMutex
+	projectID string
+	locations []string
+	// publishers keys are the receiving location
+	publishers map[string]*pubsub.Publisher
+	// subscribers keys are of the form "from->to"
+	subscribers map[string]*pubsub.Subscriber
+	client      *pubsub.Client
+	// Logger traces messages at debug level and reports failures; nil uses capoeira.DefaultLogger.
+	Logger *slog.Logger
+	// Metrics, if set, counts messages per (from, to) pair.
+	Metrics *capoeira.Metrics
 }
 
-func NewPubSubTransport(projectID string, topicNames []string) (*PubSubTransport, error) {
-	client, err := pubsub.NewClient(context.Background(), projectID)
+// NewPubSubTransport creates the topics and subscriptions of the locations in the
+// project, or uses them if they exist.
+func NewPubSubTransport(projectID string, locations []string, opts ...option.ClientOption) (*PubSubTransport, error) {
+	ctx := context.Background()
+	client, err := pubsub.NewClient(ctx, projectID, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create new pubsub client: %w", err)
 	}
+	t := &PubSubTransport{
+		projectID:   projectID,
+		locations:   slices.Clone(locations),
+		publishers:  make(map[string]*pubsub.Publisher),
+		subscribers: make(map[string]*pubsub.Subscriber),
+		client:      client,
+	}
+	for _, to := range locations {
+		topic := t.resource("topics", to)
+		_, err := client.TopicAdminClient.CreateTopic(ctx, &pubsubpb.Topic{Name: topic})
+		if err != nil && status.Code(err) != codes.AlreadyExists {
+			client.Close()
+			return nil, fmt.Errorf("creating topic for %s: %w", to, err)
+		}
+		publisher := client.Publisher(topic)
+		publisher.EnableMessageOrdering = true
+		t.publishers[to] = publisher
+		for _, from := range locations {
+			name := t.resource("subscriptions", to+"-from-"+from)
+			_, err := client.SubscriptionAdminClient.CreateSubscription(ctx, &pubsubpb.Subscription{
+				Name:                  name,
+				Topic:                 topic,
+				Filter:                fmt.Sprintf("attributes.from = %q", from),
+				EnableMessageOrdering: true,
+			})
+			if err != nil && status.Code(err) != codes.AlreadyExists {
+				client.Close()
+				return nil, fmt.Errorf("creating subscription %s->%s: %w", from, to, err)
+			}
+			subscriber := client.Subscriber(name)
+			// one message at a time, so a receive takes only the next one
+			subscriber.ReceiveSettings.MaxOutstandingMessages = 1
+			subscriber.ReceiveSettings.NumGoroutines = 1
+			t.subscribers[from+"->"+to] = subscriber
+		}
+	}
+	return t, nil
+}
+
+// resource returns the full name of a topic or subscription. Location names are
+// escaped, as instances contain a slash.
+func (t *PubSubTransport) resource(kind, id string) string {
+	return fmt.Sprintf("projects/%s/%s/%s", t.projectID, kind, url.PathEscape(id))
+}
+
+// Close stops the publishers and closes the client.
+func (t *PubSubTransport) Close() error {
+	for _, publisher := range t.publishers {
+		publisher.Stop()
+	}
+	return t.client.Close()
+}
 
-	// client.Publisher().Publish()
-	// client.Subscriber().Receive()
+func (t *PubSubTransport) logger() *slog.Logger {
+	if t.Logger != nil {
+		return t.Logger
+	}
+	return capoeira.DefaultLogger()
 }
 
 func (t *PubSubTransport) Send(from, to string, data interface{}) {
-	t.lock.RLock()
-	topic, ok := t.topics[to]
-	t.lock.RUnlock()
+	if err := t.SendContext(context.Background(), from, to, data); err != nil {
+		t.logger().Error("send failed", "location", from, "peer", to, "err", err)
+	}
+}
+
+// SendContext publishes the message, propagating the trace context of ctx in its attributes.
+func (t *PubSubTransport) SendContext(ctx context.Context, from, to string, data interface{}) error {
+	size, err := t.send(ctx, from, to, data)
+	t.Metrics.ObserveSend(from, to, size, err)
+	return err
+}
+
+// send publishes the message and returns the size of its data.
+func (t *PubSubTransport) send(ctx context.Context, from, to string, data interface{}) (int, error) {
+	publisher, ok := t.publishers[to]
 	if !ok {
-		fmt.Fprintf(os.Stderr, "Topic %s not found\n", to)
-		return
+		return 0, fmt.Errorf("topic %s not found", to)
 	}
-	ctx := context.Background()
 	msg := &pubsub.Message{
 		Attributes: map[string]string{
 			"from": from,
 			"to":   to,
 		},
-		Data: []byte(fmt.Sprintf("%v", data)),
+		OrderingKey: from,
 	}
-	result := topic.Publish(ctx, msg)
+	var err error
+	if msg.Data, err = json.Marshal(data); err != nil {
+		return 0, fmt.Errorf("marshaling data: %w", err)
+	}
+	capoeira.InjectTrace(ctx, propagation.MapCarrier(msg.Attributes))
+	result := publisher.Publish(ctx, msg)
 	id, err := result.Get(ctx)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to publish: %v\n", err)
-		return
+		publisher.ResumePublish(from)
+		return 0, fmt.Errorf("failed to publish: %w", err)
 	}
-	fmt.Printf("Published message with ID: %s\n", id)
+	t.logger().Debug("published message", "location", from, "peer", to, "id", id)
+	return len(msg.Data), nil
 }
 
 func (t *PubSubTransport) Receive(from, at string) interface{} {
-	t.lock.RLock()
-	sub, ok := t.subscriptions[at]
-	t.lock.RUnlock()
+	received, _, err := t.ReceiveContext(context.Background(), from, at)
+	if err != nil {
+		t.logger().Error("receive failed", "location", at, "peer", from, "err", err)
+	}
+	return received
+}
+
+// ReceiveContext waits for a message from the peer, extracting the trace context from its attributes.
+func (t *PubSubTransport) ReceiveContext(ctx context.Context, from, at string) (interface{}, context.Context, error) {
+	sub, ok := t.subscribers[from+"->"+at]
 	if !ok {
-		fmt.Fprintf(os.Stderr, "Subscription %s not found\n", at)
-		return nil
+		return nil, ctx, fmt.Errorf("subscription %s->%s not found", from, at)
 	}
-	ctx := context.Background()
 	var received interface{}
+	var size int
+	var got bool
+	remote := ctx
+	start := time.Now()
 	cctx, cancel := context.WithCancel(ctx)
-	err := sub.Receive(cctx, func(ctx context.Context, msg *pubsub.Message) {
-		if msg.Attributes["from"] == from {
-			received = string(msg.Data)
+	defer cancel()
+	err := sub.Receive(cctx, func(_ context.Context, msg *pubsub.Message) {
+		if got {
+			// pulled before the receive was cancelled; leave it for the next one
+			msg.Nack()
+			return
+		}
+		if err := json.Unmarshal(msg.Data, &received); err != nil {
+			t.logger().Error("dropping undecodable message", "location", at, "peer", from, "err", err)
 			msg.Ack()
-			cancel()
+			return
 		}
+		got, size = true, len(msg.Data)
+		remote = capoeira.ExtractTrace(ctx, propagation.MapCarrier(msg.Attributes))
+		msg.Ack()
+		cancel()
 	})
+	if err == nil && !got {
+		// Receive returns nil when cancelled, so this was the caller giving up
+		err = ctx.Err()
+	}
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to receive: %v\n", err)
-		return nil
+		return nil, ctx, fmt.Errorf("failed to receive: %w", err)
 	}
-	return received
+	t.Metrics.ObserveReceive(from, at, size, start)
+	t.logger().Debug("received", "location", at, "peer", from, "data", received)
+	return received, remote, nil
 }
 
 func (t *PubSubTransport) Locations() []string {
-	locs := make([]string, 0, len(t.topics))
-	for k := range t.topics {
-		locs = append(locs, k)
-	}
-	return locs
+	return t.locations
+}
+
+func (t *PubSubTransport) Codec() string {
+	return "json"
 }
@@ -0,0 +1,65 @@
+package gcp
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub/v2/pstest"
+	"github.com/danielc-lh/scripts/capoeira"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestPubSubDeliversInOrderPerSender(t *testing.T) {
+	srv := pstest.NewServer()
+	defer srv.Close()
+	conn, err := grpc.NewClient(srv.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	transport, err := NewPubSubTransport("capoeira", []string{"Seller", "Buyer/b-17"}, option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+	transport.Metrics = capoeira.NewMetrics()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, title := range []string{"TAPL", "HoTT"} {
+		if err := transport.SendContext(ctx, "Buyer/b-17", "Seller", title); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := transport.SendContext(ctx, "Seller", "Seller", "stock"); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"TAPL", "HoTT"} {
+		got, _, err := transport.ReceiveContext(ctx, "Buyer/b-17", "Seller")
+		if err != nil || got != want {
+			t.Fatalf("expected %q from the buyer, got %v (%v)", want, got, err)
+		}
+	}
+	if got, _, err := transport.ReceiveContext(ctx, "Seller", "Seller"); err != nil || got != "stock" {
+		t.Errorf("expected the seller's own message, got %v (%v)", got, err)
+	}
+
+	counts := `
+# HELP capoeira_messages_received_total Messages received.
+# TYPE capoeira_messages_received_total counter
+capoeira_messages_received_total{from="Buyer/b-17",to="Seller"} 2
+capoeira_messages_received_total{from="Seller",to="Seller"} 1
+# HELP capoeira_messages_sent_total Messages sent.
+# TYPE capoeira_messages_sent_total counter
+capoeira_messages_sent_total{from="Buyer/b-17",to="Seller"} 2
+capoeira_messages_sent_total{from="Seller",to="Seller"} 1
+`
+	if err := testutil.GatherAndCompare(transport.Metrics.Registry, strings.NewReader(counts), "capoeira_messages_sent_total", "capoeira_messages_received_total"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,140 @@
+package capoeira
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Handshake is what a location announces to its peers before a run of a registered
+// choreography, or any run when its projector has Handshake set.
+type Handshake struct {
+	Choreography string `json:"choreography"`
+	// Version is a hash of the choreography's version, so endpoints built from
+	// different versions of it don't misread each other's messages.
+	Version string `json:"version"`
+	// Codec is how the transport encodes messages on the way.
+	Codec string `json:"codec"`
+}
+
+// Versioned is implemented by choreographies that name their version. Choreographies
+// that don't are versioned as registered with RegisterChoreography, or else by the
+// shape of their type.
+type Versioned interface {
+	Version() string
+}
+
+// HandshakeError reports that a peer announced a different choreography, version or
+// codec, so the run was abandoned before any other message was exchanged.
+type HandshakeError struct {
+	Location string
+	Peer     string
+	Local    Handshake
+	Remote   Handshake
+}
+
+func (e *HandshakeError) Error() string {
+	var diffs []string
+	if e.Local.Choreography != e.Remote.Choreography {
+		diffs = append(diffs, fmt.Sprintf("choreography %s, not %s", e.Remote.Choreography, e.Local.Choreography))
+	}
+	if e.Local.Version != e.Remote.Version {
+		diffs = append(diffs, fmt.Sprintf("version %s, not %s", e.Remote.Version, e.Local.Version))
+	}
+	if e.Local.Codec != e.Remote.Codec {
+		diffs = append(diffs, fmt.Sprintf("codec %q, not %q", e.Remote.Codec, e.Local.Codec))
+	}
+	return fmt.Sprintf("capoeira: %s runs %s at %s", e.Peer, strings.Join(diffs, ", "), e.Location)
+}
+
+// handshakeFor returns what a location running choreo over t announces.
+func handshakeFor(choreo Choreography, t Transport) Handshake {
+	name := fmt.Sprintf("%T", choreo)
+	info, registered := registeredInfo(choreo)
+	if registered {
+		name = info.Name
+	}
+	var version string
+	switch v, ok := choreo.(Versioned); {
+	case ok:
+		version = v.Version()
+	case registered && info.Version != "":
+		version = info.Version
+	default:
+		version = typeShape(reflect.TypeOf(choreo))
+	}
+	sum := sha256.Sum256([]byte(version))
+	return Handshake{
+		Choreography: name,
+		Version:      hex.EncodeToString(sum[:8]),
+		Codec:        codecOf(t),
+	}
+}
+
+// typeShape describes a type by its name and the names and types of its fields.
+func typeShape(t reflect.Type) string {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return t.String()
+	}
+	fields := make([]string, t.NumField())
+	for i := range fields {
+		fields[i] = t.Field(i).Name + " " + t.Field(i).Type.String()
+	}
+	return t.String() + "{" + strings.Join(fields, "; ") + "}"
+}
+
+// shakeHands announces hs to every other location taking part in the run and checks
+// each of them announces the same, aborting the run with a *HandshakeError if not.
+// Every location sends before it receives, so no one waits on anyone else's check.
+func (op ProjectorChoreoOp) shakeHands(hs Handshake) {
+	seq := op.next()
+	var peers []string
+	for _, peer := range op.locations() {
+		if peer != op.Target.Name() {
+			peers = append(peers, peer)
+		}
+	}
+	ctx, span := op.span("Handshake", seq, peers...)
+	defer span.End()
+	for _, peer := range peers {
+		op.send(ctx, seq, peer, hs)
+	}
+	// take every peer's handshake before checking any, so none is left queued
+	remotes := make([]interface{}, len(peers))
+	for i, peer := range peers {
+		remotes[i] = op.receive(ctx, seq, peer)
+	}
+	for i, peer := range peers {
+		remote, err := toHandshake(remotes[i])
+		if err != nil {
+			panic(runAbort{fmt.Errorf("capoeira: handshake from %s: %w", peer, err)})
+		}
+		if remote != hs {
+			panic(runAbort{&HandshakeError{Location: op.Target.Name(), Peer: peer, Local: hs, Remote: remote}})
+		}
+	}
+	op.debug("shook hands", "handshake", seq, "", "peers", peers)
+}
+
+// toHandshake recovers a handshake from what the transport delivered, which is a
+// generic value if the transport encoded it on the way.
+func toHandshake(data interface{}) (Handshake, error) {
+	if hs, ok := data.(Handshake); ok {
+		return hs, nil
+	}
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return Handshake{}, err
+	}
+	var hs Handshake
+	if err := json.Unmarshal(raw, &hs); err != nil || hs.Choreography == "" {
+		return Handshake{}, fmt.Errorf("not a handshake: %.80s", raw)
+	}
+	return hs, nil
+}
@@ -0,0 +1,74 @@
+package capoeira
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+type versionedRelay struct {
+	relayChoreography
+	version string
+}
+
+func (c versionedRelay) Version() string {
+	return c.version
+}
+
+func TestHandshakeRejectsStaleEndpoint(t *testing.T) {
+	locations := []Location{Ticketer{}, ParkingAuthority{}, Printer{}}
+	run := func(versions map[Location]string) map[string]error {
+		transport := NewChannelTransport([]string{Ticketer{}.Name(), ParkingAuthority{}.Name(), Printer{}.Name()})
+		errs := make(chan error)
+		for _, loc := range locations {
+			go func() {
+				p := NewProjector(loc, transport)
+				p.Handshake = true
+				_, err := p.EppAndRunContext(context.Background(), versionedRelay{version: versions[loc]})
+				errs <- err
+			}()
+		}
+		results := make(map[string]error)
+		for range locations {
+			err := <-errs
+			var mismatch *HandshakeError
+			if errors.As(err, &mismatch) {
+				results[mismatch.Location] = err
+			} else if err != nil {
+				t.Errorf("expected a handshake error, got %v", err)
+			}
+		}
+		return results
+	}
+
+	if errs := run(map[Location]string{Ticketer{}: "1", ParkingAuthority{}: "1", Printer{}: "1"}); len(errs) > 0 {
+		t.Fatalf("expected matching endpoints to run, got %v", errs)
+	}
+	errs := run(map[Location]string{Ticketer{}: "1", ParkingAuthority{}: "1", Printer{}: "0"})
+	if len(errs) != len(locations) {
+		t.Fatalf("expected every location to fail the handshake, got %v", errs)
+	}
+	var mismatch *HandshakeError
+	errors.As(errs[Ticketer{}.Name()], &mismatch)
+	if mismatch.Peer != (Printer{}).Name() {
+		t.Errorf("expected the ticketer to blame the printer, got %v", mismatch)
+	}
+}
+
+func TestRegisteredChoreographiesShakeHands(t *testing.T) {
+	transport := NewChannelTransport([]string{Seller{}.Name(), Buyer{}.Name()}, WithCapacity(Unbounded))
+	errs := make(chan error)
+	go func() {
+		seller := NewProjector(Seller{}, transport)
+		_, err := seller.EppAndRunContext(context.Background(), BooksellerChoreography{Title: seller.Remote(Buyer{}), Budget: seller.Remote(Buyer{})})
+		errs <- err
+	}()
+	// a buyer from before handshakes
+	buyer := NewProjector(Buyer{}, transport)
+	buyer.SkipHandshake = true
+	buyer.EppAndRunContext(context.Background(), BooksellerChoreography{Title: buyer.Local("TAPL"), Budget: buyer.Local(BUDGET)})
+	if err := <-errs; err == nil || !strings.Contains(err.Error(), "handshake from Buyer") {
+		t.Errorf("expected the seller to expect a handshake, got %v", err)
+	}
+}
@@ -2,80 +2,413 @@ package capoeira
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	mrand "math/rand/v2"
+	"net"
 	"net/http"
+	"slices"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/propagation"
 )
 
 type HTTPTransport struct {
-	endpoints []string
-	// channel keys are of the form "from->to"
-	receivedMessages map[string]chan interface{}
+	members *Membership
+	// mailbox keys are of the form "from->to"
+	receivedMessages map[string]*mailbox
+	capacity         int
 	server           *http.Server
 	port             int
-	lock             sync.RWMutex
+	lock             sync.Mutex
+	// Logger traces messages at debug level and reports failures; it defaults to DefaultLogger.
+	Logger *slog.Logger
+	// Metrics counts messages per (from, to) pair, tracks how full their queues are
+	// and is served on /metrics.
+	Metrics *Metrics
+	tls     *TLSConfig
+	// clients keys are the sending location, which picks the client certificate
+	clients    map[string]*http.Client
+	httpClient *http.Client
+	// attempts is how many times a message is posted before giving up, backing off
+	// from backoff between attempts
+	attempts  int
+	backoff   time.Duration
+	delivered *recentIDs
+	// registry, if set, is where the local locations are registered and peers resolved,
+	// with addresses cached in book
+	registry  Registry
+	local     []string
+	advertise string
+	book      addressBook
+	stopWatch context.CancelFunc
+	// sending and handling count the messages being sent and received, and draining
+	// is set once Shutdown starts
+	sending  atomic.Int64
+	handling atomic.Int64
+	draining atomic.Bool
+	// onDrain, if set, is called once Shutdown has started draining
+	onDrain func()
+}
+
+// HTTPOption configures an HTTPTransport before its server starts.
+type HTTPOption func(*HTTPTransport)
+
+// WithPort sets the port the server listens on and messages are posted to. Port 0
+// picks a free port.
+func WithPort(port int) HTTPOption {
+	return func(t *HTTPTransport) {
+		t.port = port
+	}
+}
+
+// WithQueueCapacity sets how many messages from one location to another are queued
+// before the request posting the next one waits for the receiver, or Unbounded so
+// requests never wait. The default is 1.
+func WithQueueCapacity(n int) HTTPOption {
+	return func(t *HTTPTransport) {
+		t.capacity = n
+	}
+}
+
+// WithRegistry registers the local locations at the server's address and posts to
+// the addresses registered for the others, watching a FileRegistry for changes.
+func WithRegistry(r Registry, local ...string) HTTPOption {
+	return func(t *HTTPTransport) {
+		t.registry, t.local = r, local
+	}
+}
+
+// WithAdvertiseHost sets the host other endpoints reach the server at, for the
+// addresses registered by WithRegistry. The default is localhost.
+func WithAdvertiseHost(host string) HTTPOption {
+	return func(t *HTTPTransport) {
+		t.advertise = host
+	}
+}
+
+// WithHTTPClient posts messages with c, rather than a client built from the TLS config.
+func WithHTTPClient(c *http.Client) HTTPOption {
+	return func(t *HTTPTransport) {
+		t.httpClient = c
+	}
+}
+
+// WithRetry sets how many times a message is posted before the send fails, waiting
+// backoff after the first failed attempt and twice as long after each one after that.
+func WithRetry(attempts int, backoff time.Duration) HTTPOption {
+	return func(t *HTTPTransport) {
+		t.attempts, t.backoff = max(attempts, 1), backoff
+	}
 }
 
-func NewHTTPTransport(endpoints []string) *HTTPTransport {
+func NewHTTPTransport(endpoints []string, opts ...HTTPOption) *HTTPTransport {
 	t := &HTTPTransport{
-		endpoints:        endpoints,
-		receivedMessages: make(map[string]chan interface{}),
+		members:          NewMembership(endpoints...),
+		receivedMessages: make(map[string]*mailbox),
+		capacity:         1,
 		port:             8080,
+		Logger:           DefaultLogger(),
+		Metrics:          NewMetrics(),
+		clients:          make(map[string]*http.Client),
+		attempts:         5,
+		backoff:          100 * time.Millisecond,
+		delivered:        newRecentIDs(4096),
+		advertise:        "localhost",
 	}
-	for _, endpoint := range endpoints {
-		if _, ok := t.receivedMessages[endpoint]; !ok {
-			t.receivedMessages[endpoint] = make(chan interface{}, 1) // buffered channel to avoid deadlock
-		}
+	for _, opt := range opts {
+		opt(t)
+	}
+	if err := t.StartServer(); err != nil {
+		t.Logger.Error("HTTPTransport server failed to start", "err", err)
 	}
-	t.StartServer()
 	return t
 }
 
 func (t *HTTPTransport) Send(from, to string, data any) {
-	fmt.Println("HTTPTransport sending from", from, "to", to, "data:", data)
+	if err := t.SendContext(context.Background(), from, to, data); err != nil {
+		t.Logger.Error("send failed", "location", from, "peer", to, "err", err)
+	}
+}
+
+// SendContext posts the message to the peer, propagating the trace context of ctx in the request headers.
+func (t *HTTPTransport) SendContext(ctx context.Context, from, to string, data interface{}) error {
+	t.sending.Add(1)
+	defer t.sending.Add(-1)
+	size, err := t.send(ctx, from, to, data)
+	t.Metrics.ObserveSend(from, to, size, err)
+	return err
+}
+
+// send posts the message until the peer acknowledges it and returns the size of its
+// encoded body. Every attempt carries the same message ID, from ctx if it has one,
+// so the peer delivers it once however many attempts reach it.
+func (t *HTTPTransport) send(ctx context.Context, from, to string, data interface{}) (int, error) {
+	t.Logger.Debug("sending", "location", from, "peer", to, "data", data)
+	id := MessageIDFromContext(ctx)
+	if id == "" {
+		id = rand.Text()
+	}
 	payload := map[string]any{
+		"id":   id,
 		"from": from,
 		"to":   to,
 		"data": data,
 	}
-	fmt.Println("Payload:", payload)
 
 	b, err := json.Marshal(payload)
 
 	if err != nil {
-		fmt.Printf("Error marshaling payload: %v\n", err)
-		return
+		return 0, fmt.Errorf("marshaling payload: %w", err)
 	}
-	resp, err := http.Post("http://localhost:8080/message", "application/json", bytes.NewBuffer(b))
+	for attempt := 1; ; attempt++ {
+		err = t.post(ctx, from, to, id, b)
+		if err == nil {
+			return len(b), nil
+		}
+		var status *statusError
+		if attempt >= t.attempts || errors.As(err, &status) && !status.retryable() {
+			return 0, err
+		}
+		wait := t.backoff << (attempt - 1)
+		wait += mrand.N(wait/2 + 1)
+		t.Logger.Warn("retrying send", "location", from, "peer", to, "id", id, "attempt", attempt, "wait", wait, "err", err)
+		t.Metrics.ObserveRetry(from, to)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// post makes one attempt at delivering a message, checking the peer acknowledged it.
+func (t *HTTPTransport) post(ctx context.Context, from, to, id string, body []byte) error {
+	address, err := t.resolve(to)
 	if err != nil {
-		fmt.Printf("Error sending HTTP request: %v\n", err)
-		return
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.scheme()+"://"+address+"/message", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating HTTP request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	InjectTrace(ctx, propagation.HeaderCarrier(req.Header))
+	resp, err := t.client(from).Do(req)
+	if err != nil {
+		return fmt.Errorf("sending HTTP request: %w", err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		fmt.Printf("Non-OK HTTP status: %s\n", resp.Status)
+		return &statusError{code: resp.StatusCode, status: resp.Status}
+	}
+	var ack struct {
+		Ack string `json:"ack"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&ack); err != nil || ack.Ack != id {
+		return fmt.Errorf("message %s not acknowledged", id)
+	}
+	return nil
+}
+
+// statusError is a response other than 200 to a posted message.
+type statusError struct {
+	code   int
+	status string
+}
+
+func (e *statusError) Error() string {
+	return "non-OK HTTP status: " + e.status
+}
+
+// retryable reports whether posting again might succeed, i.e. the peer failed rather
+// than rejected the message.
+func (e *statusError) retryable() bool {
+	return e.code >= 500 || e.code == http.StatusTooManyRequests
+}
+
+// recentIDs remembers the IDs of the last messages delivered, so a message posted
+// again after its acknowledgement was lost isn't delivered twice.
+type recentIDs struct {
+	lock sync.Mutex
+	// seen is false for IDs being delivered
+	seen  map[string]bool
+	order []string
+	limit int
+}
+
+func newRecentIDs(limit int) *recentIDs {
+	return &recentIDs{seen: make(map[string]bool), limit: limit}
+}
+
+// begin claims id for delivery, unless it was delivered already or is being delivered.
+func (r *recentIDs) begin(id string) (delivered, busy bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if done, ok := r.seen[id]; ok {
+		return done, !done
 	}
+	r.seen[id] = false
+	return false, false
+}
+
+// finish records whether id was delivered; if not, it can be claimed again.
+func (r *recentIDs) finish(id string, delivered bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !delivered {
+		delete(r.seen, id)
+		return
+	}
+	r.seen[id] = true
+	r.order = append(r.order, id)
+	if len(r.order) > r.limit {
+		delete(r.seen, r.order[0])
+		r.order = r.order[1:]
+	}
+}
+
+// mailbox returns the queue for messages from one location to another, creating it if needed.
+func (t *HTTPTransport) mailbox(from, to string) *mailbox {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	key := from + "->" + to
+	mb, ok := t.receivedMessages[key]
+	if !ok {
+		mb = newMailbox(t.capacity)
+		t.receivedMessages[key] = mb
+	}
+	return mb
 }
 
 func (t *HTTPTransport) Receive(from, at string) interface{} {
-	t.lock.RLock()
-	defer t.lock.RUnlock()
-	fmt.Printf("Receiving on %s...\n", at)
-	val := <-t.receivedMessages[at]
-	fmt.Printf("Received at %s from %s: %v of type %T\n", at, from, val, val)
+	val, _, _ := t.ReceiveContext(context.Background(), from, at)
 	return val
 }
 
+// ReceiveContext waits for a message posted by the peer, extracting the trace context from its request headers.
+func (t *HTTPTransport) ReceiveContext(ctx context.Context, from, at string) (interface{}, context.Context, error) {
+	log := t.Logger.With("location", at, "peer", from)
+	log.Debug("receiving")
+	start := time.Now()
+	msg, depth, err := t.mailbox(from, at).take(ctx)
+	if err != nil {
+		return nil, ctx, err
+	}
+	t.Metrics.ObserveReceive(from, at, msg.size, start)
+	t.Metrics.ObserveQueue(from, at, depth)
+	log.Debug("received", "data", msg.data, "type", fmt.Sprintf("%T", msg.data))
+	return msg.data, ExtractTrace(ctx, msg.trace), nil
+}
+
 func (t *HTTPTransport) Locations() []string {
-	return t.endpoints
+	return t.members.View().Locations
 }
 
-// StartServer starts an HTTP server to listen for incoming messages on the given port
-func (t *HTTPTransport) StartServer() error {
+// Membership returns the locations of the transport, to add or remove some.
+func (t *HTTPTransport) Membership() *Membership {
+	return t.members
+}
+
+func (t *HTTPTransport) Codec() string {
+	return "json"
+}
+
+// Addr returns the address other endpoints reach the server at.
+func (t *HTTPTransport) Addr() string {
+	return net.JoinHostPort(t.advertise, strconv.Itoa(t.port))
+}
+
+// url returns the address of a route on the server.
+func (t *HTTPTransport) url(path string) string {
+	return t.scheme() + "://" + t.Addr() + path
+}
+
+func (t *HTTPTransport) scheme() string {
+	if t.tls != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// resolve returns the address of the endpoint serving a location: this server's,
+// unless a registry says otherwise.
+func (t *HTTPTransport) resolve(location string) (string, error) {
+	if t.registry == nil || slices.Contains(t.local, location) {
+		return t.Addr(), nil
+	}
+	if address, ok := t.book.get(location); ok {
+		return address, nil
+	}
+	address, err := t.registry.Resolve(location)
+	if err != nil {
+		return "", err
+	}
+	t.book.set(location, address)
+	return address, nil
+}
+
+// register registers the local locations and starts watching the registry for peers.
+func (t *HTTPTransport) register() error {
+	for _, location := range t.local {
+		if err := t.registry.Register(location, t.Addr()); err != nil {
+			return err
+		}
+	}
+	watcher, ok := t.registry.(interface {
+		Watch(ctx context.Context, interval time.Duration, changed func(map[string]string))
+	})
+	if !ok {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.stopWatch = cancel
+	go watcher.Watch(ctx, time.Second, func(addresses map[string]string) {
+		added, removed := t.book.replace(addresses)
+		for _, location := range added {
+			t.members.AddLocation(location)
+		}
+		for _, location := range removed {
+			t.members.RemoveLocation(location)
+		}
+		t.Logger.Debug("registry changed", "added", added, "removed", removed)
+	})
+	return nil
+}
+
+// client returns the HTTP client a location sends with.
+func (t *HTTPTransport) client(from string) *http.Client {
+	if t.httpClient != nil {
+		return t.httpClient
+	}
+	if t.tls == nil {
+		return http.DefaultClient
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	c, ok := t.clients[from]
+	if !ok {
+		c = &http.Client{Transport: &http.Transport{TLSClientConfig: t.tls.client(from)}}
+		t.clients[from] = c
+	}
+	return c
+}
+
+// handler routes the server's requests.
+func (t *HTTPTransport) handler() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/message", func(w http.ResponseWriter, r *http.Request) {
+		t.handling.Add(1)
+		defer t.handling.Add(-1)
 		if r.Method != http.MethodPost {
 			http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
 			return
@@ -90,31 +423,198 @@ func (t *HTTPTransport) StartServer() error {
 			http.Error(w, "Error parsing JSON", http.StatusBadRequest)
 			return
 		}
-		fmt.Println("Received payload:", payload)
+		id, _ := payload["id"].(string)
+		from, _ := payload["from"].(string)
 		to, _ := payload["to"].(string)
-		// put the received message onto the channel for this pair of from/to locations
-		t.lock.RLock()
-		t.receivedMessages[to] <- payload["data"]
-		fmt.Printf("Wrote %v to channel %v\n", payload["data"], to)
-		t.lock.RUnlock()
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("OK"))
+		if err := t.verifyPeer(r, from); err != nil {
+			t.Logger.Warn("rejected message", "location", to, "peer", from, "err", err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		ack, _ := json.Marshal(map[string]string{"ack": id})
+		if id != "" {
+			delivered, busy := t.delivered.begin(id)
+			if delivered {
+				t.Logger.Debug("acknowledging duplicate message", "location", to, "peer", from, "id", id)
+				w.Write(ack)
+				return
+			}
+			if busy {
+				http.Error(w, "message being delivered", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		msg := message{data: payload["data"], trace: propagation.MapCarrier{}, size: len(body)}
+		for _, field := range traceFields() {
+			if v := r.Header.Get(field); v != "" {
+				msg.trace.Set(field, v)
+			}
+		}
+		// put the received message onto the queue for this pair of from/to locations,
+		// holding the request until there is room
+		depth, blocked, err := t.mailbox(from, to).put(r.Context(), msg)
+		if id != "" {
+			t.delivered.finish(id, err == nil)
+		}
+		if err != nil {
+			http.Error(w, "sender gone", http.StatusServiceUnavailable)
+			return
+		}
+		if blocked {
+			t.Metrics.ObserveBlocked(from, to)
+		}
+		t.Metrics.ObserveQueue(from, to, depth)
+		t.Logger.Debug("queued message", "location", to, "peer", from, "id", id, "data", payload["data"])
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(ack)
+	})
+	// healthz answers as long as the server is listening
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if t.draining.Load() {
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		defer cancel()
+		if err := t.checkPeers(ctx); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
 	})
+	if t.Metrics != nil {
+		mux.Handle("/metrics", t.Metrics.Handler())
+	}
+	return mux
+}
+
+// checkPeers checks the endpoint of every other location is answering on /healthz.
+func (t *HTTPTransport) checkPeers(ctx context.Context) error {
+	var from string
+	if len(t.local) > 0 {
+		from = t.local[0]
+	}
+	checked := map[string]bool{t.Addr(): true}
+	var errs []error
+	for _, location := range t.Locations() {
+		address, err := t.resolve(location)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if checked[address] {
+			continue
+		}
+		checked[address] = true
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.scheme()+"://"+address+"/healthz", nil)
+		if err != nil {
+			return err
+		}
+		resp, err := t.client(from).Do(req)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s unreachable: %w", location, err))
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			errs = append(errs, fmt.Errorf("%s unhealthy: %s", location, resp.Status))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// StartServer starts an HTTP server to listen for incoming messages on the given port
+func (t *HTTPTransport) StartServer() error {
 	addr := fmt.Sprintf(":%d", t.port)
-	t.server = &http.Server{Addr: addr, Handler: mux}
+	t.server = &http.Server{Addr: addr, Handler: t.handler(), ErrorLog: slog.NewLogLogger(t.Logger.Handler(), slog.LevelWarn)}
+	// listen before returning, so messages sent right away aren't refused
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listening on %s: %w", addr, err)
+	}
+	t.port = ln.Addr().(*net.TCPAddr).Port
+	if t.tls != nil {
+		ln = tls.NewListener(ln, t.tls.server())
+	}
 	go func() {
-		if err := t.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			fmt.Printf("HTTP server error: %v\n", err)
+		if err := t.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			t.Logger.Error("HTTP server failed", "err", err)
 		}
 	}()
-	fmt.Printf("HTTPTransport server started on port %d\n", t.port)
+	t.Logger.Info("HTTPTransport server started", "port", t.port)
+	if t.registry != nil {
+		return t.register()
+	}
 	return nil
 }
 
-// StopServer gracefully stops the HTTP server
+// StopServer stops the HTTP server at once, deregistering the local locations.
+// Messages being posted or waiting to be received are lost; Shutdown lets them
+// drain first.
 func (t *HTTPTransport) StopServer() error {
+	t.deregister()
 	if t.server != nil {
 		return t.server.Close()
 	}
 	return nil
 }
+
+// Shutdown deregisters the local locations, fails /readyz and waits for the messages
+// being sent, received or queued before shutting the server down, closing it if ctx
+// is done first.
+func (t *HTTPTransport) Shutdown(ctx context.Context) error {
+	t.draining.Store(true)
+	t.deregister()
+	if t.onDrain != nil {
+		t.onDrain()
+	}
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for !t.idle() {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			t.Logger.Warn("HTTPTransport shutdown timed out before draining", "sending", t.sending.Load(), "queued", t.queued())
+			t.server.Close()
+			return ctx.Err()
+		}
+	}
+	if err := t.server.Shutdown(ctx); err != nil {
+		t.Logger.Warn("HTTPTransport shutdown timed out", "err", err)
+		t.server.Close()
+		return err
+	}
+	t.Logger.Info("HTTPTransport server shut down", "port", t.port)
+	return nil
+}
+
+// idle reports whether no message is being sent, received or waiting to be received.
+func (t *HTTPTransport) idle() bool {
+	return t.sending.Load() == 0 && t.handling.Load() == 0 && t.queued() == 0
+}
+
+// queued counts the messages waiting to be received.
+func (t *HTTPTransport) queued() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	n := 0
+	for _, mb := range t.receivedMessages {
+		n += mb.len()
+	}
+	return n
+}
+
+// deregister stops watching the registry and deregisters the local locations.
+func (t *HTTPTransport) deregister() {
+	if t.stopWatch != nil {
+		t.stopWatch()
+	}
+	for _, location := range t.local {
+		if err := t.registry.Deregister(location); err != nil {
+			t.Logger.Warn("deregistering failed", "location", location, "err", err)
+		}
+	}
+}
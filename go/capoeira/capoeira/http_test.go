@@ -0,0 +1,114 @@
+package capoeira
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// loseFirstAck posts requests, but reports the first one failed once it's delivered.
+type loseFirstAck struct {
+	requests atomic.Int32
+}
+
+func (l *loseFirstAck) RoundTrip(r *http.Request) (*http.Response, error) {
+	n := l.requests.Add(1)
+	resp, err := http.DefaultTransport.RoundTrip(r)
+	if err != nil || n > 1 {
+		return resp, err
+	}
+	resp.Body.Close()
+	rec := httptest.NewRecorder()
+	http.Error(rec, "gateway timeout", http.StatusGatewayTimeout)
+	return rec.Result(), nil
+}
+
+func TestHTTPRetriesDeliverOnce(t *testing.T) {
+	flaky := &loseFirstAck{}
+	transport := NewHTTPTransport([]string{Seller{}.Name(), Buyer{}.Name()}, WithPort(0), WithRetry(3, time.Millisecond), WithHTTPClient(&http.Client{Transport: flaky}))
+	defer transport.StopServer()
+
+	go func() {
+		transport.Send(Seller{}.Name(), Buyer{}.Name(), "first")
+		transport.Send(Seller{}.Name(), Buyer{}.Name(), "second")
+	}()
+	for _, want := range []string{"first", "second"} {
+		if got := transport.Receive(Seller{}.Name(), Buyer{}.Name()); got != want {
+			t.Fatalf("expected %q, got %v", want, got)
+		}
+	}
+	if n := flaky.requests.Load(); n != 3 {
+		t.Errorf("expected 3 requests, got %d", n)
+	}
+}
+
+func TestHTTPShutdownDrainsQueues(t *testing.T) {
+	transport := NewHTTPTransport([]string{Seller{}.Name(), Buyer{}.Name()}, WithPort(0))
+	// a fresh connection per check, so none is left open for the shutdown to wait on
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	status := func(path string) int {
+		resp, err := client.Get(transport.url(path))
+		if err != nil {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status("/healthz") != http.StatusOK || status("/readyz") != http.StatusOK {
+		t.Fatalf("expected a healthy, ready transport")
+	}
+
+	transport.Send(Seller{}.Name(), Buyer{}.Name(), "last order")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	draining, stopped := make(chan struct{}), make(chan error)
+	transport.onDrain = func() { close(draining) }
+	go func() { stopped <- transport.Shutdown(ctx) }()
+	<-draining
+	if got := status("/readyz"); got != http.StatusServiceUnavailable {
+		t.Errorf("expected a draining transport not to be ready, got %d", got)
+	}
+	// nothing takes the message until the receive below, so the shutdown is still draining
+	select {
+	case err := <-stopped:
+		t.Fatalf("shut down with a message queued: %v", err)
+	default:
+	}
+	if got := transport.Receive(Seller{}.Name(), Buyer{}.Name()); got != "last order" {
+		t.Errorf("expected the queued message, got %v", got)
+	}
+	if err := <-stopped; err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+	if status("/healthz") != 0 {
+		t.Errorf("expected the server to be stopped")
+	}
+}
+
+func TestHTTPNotReadyWithoutPeers(t *testing.T) {
+	registry, err := NewFileRegistry(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry.Register(Seller{}.Name(), ln.Addr().String())
+	ln.Close()
+	transport := NewHTTPTransport([]string{Seller{}.Name(), Buyer{}.Name()}, WithPort(0), WithRegistry(registry, Buyer{}.Name()))
+	defer transport.StopServer()
+
+	resp, err := http.Get(transport.url("/readyz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected not ready while the seller is unreachable, got %s", resp.Status)
+	}
+}
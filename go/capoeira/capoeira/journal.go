@@ -0,0 +1,232 @@
+package capoeira
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sync"
+)
+
+// Journal records the completed operations of runs at one location, by session,
+// sequence number and peer ("" for Locally), so a run resumed after a crash replays them.
+type Journal interface {
+	// Lookup returns the value recorded for an operation, if it completed.
+	Lookup(session string, seq uint64, peer string) (interface{}, bool)
+	// Record records the value of a completed operation. An error aborts the run.
+	Record(session string, seq uint64, peer string, value interface{}) error
+}
+
+var journalTypes struct {
+	lock   sync.RWMutex
+	byName map[string]reflect.Type
+}
+
+func init() {
+	// what a JSON transport delivers comes back from JSON as it is
+	for _, value := range []interface{}{false, "", 0, int64(0), uint64(0), float64(0), []interface{}(nil), map[string]interface{}(nil)} {
+		registerJournalType(reflect.TypeOf(value))
+	}
+}
+
+// RegisterJournalType registers the type of value so FileJournal replays values of it
+// as that type; recording a value of a type that isn't registered fails. Call it from
+// init; it panics if the type doesn't survive JSON, such as a struct with unexported
+// fields and no json.Marshaler.
+func RegisterJournalType(value interface{}) {
+	typ := reflect.TypeOf(value)
+	if err := checkJSONType(typ, make(map[reflect.Type]bool)); err != nil {
+		panic(fmt.Sprintf("capoeira: can't journal %s: %v", typ, err))
+	}
+	registerJournalType(typ)
+}
+
+func registerJournalType(typ reflect.Type) {
+	journalTypes.lock.Lock()
+	defer journalTypes.lock.Unlock()
+	if journalTypes.byName == nil {
+		journalTypes.byName = make(map[string]reflect.Type)
+	}
+	journalTypes.byName[journalTypeName(typ)] = typ
+}
+
+// journalTypeName names a type by its package path, so types of the same name in
+// different packages don't collide.
+func journalTypeName(typ reflect.Type) string {
+	if typ.Name() != "" && typ.PkgPath() != "" {
+		return typ.PkgPath() + "." + typ.Name()
+	}
+	return typ.String()
+}
+
+// checkJSONType returns why values of typ don't come back from JSON as they went in, if they don't.
+func checkJSONType(typ reflect.Type, seen map[reflect.Type]bool) error {
+	if seen[typ] {
+		return nil
+	}
+	seen[typ] = true
+	marshaler := reflect.TypeFor[json.Marshaler]()
+	unmarshaler := reflect.TypeFor[json.Unmarshaler]()
+	if typ.Implements(marshaler) && reflect.PointerTo(typ).Implements(unmarshaler) {
+		return nil
+	}
+	switch typ.Kind() {
+	case reflect.Struct:
+		for i := range typ.NumField() {
+			field := typ.Field(i)
+			if !field.IsExported() {
+				return fmt.Errorf("field %s is unexported", field.Name)
+			}
+			if err := checkJSONType(field.Type, seen); err != nil {
+				return fmt.Errorf("field %s: %w", field.Name, err)
+			}
+		}
+	case reflect.Pointer, reflect.Slice, reflect.Array:
+		return checkJSONType(typ.Elem(), seen)
+	case reflect.Map:
+		if err := checkJSONType(typ.Key(), seen); err != nil {
+			return err
+		}
+		return checkJSONType(typ.Elem(), seen)
+	case reflect.Interface:
+		return fmt.Errorf("%s loses its concrete type", typ)
+	case reflect.Chan, reflect.Func, reflect.Complex64, reflect.Complex128, reflect.UnsafePointer:
+		return fmt.Errorf("%s has no JSON encoding", typ.Kind())
+	}
+	return nil
+}
+
+type journalKey struct {
+	session string
+	seq     uint64
+	peer    string
+}
+
+type journalEntry struct {
+	Session string          `json:"session,omitempty"`
+	Seq     uint64          `json:"seq"`
+	Peer    string          `json:"peer,omitempty"`
+	Type    string          `json:"type,omitempty"`
+	Value   json.RawMessage `json:"value"`
+}
+
+// decode returns the entry's value as the type it was recorded as.
+func (e journalEntry) decode() (interface{}, error) {
+	if e.Type == "" {
+		return nil, nil
+	}
+	journalTypes.lock.RLock()
+	typ, ok := journalTypes.byName[e.Type]
+	journalTypes.lock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("type %s isn't registered with RegisterJournalType", e.Type)
+	}
+	value := reflect.New(typ)
+	if err := json.Unmarshal(e.Value, value.Interface()); err != nil {
+		return nil, err
+	}
+	return value.Elem().Interface(), nil
+}
+
+// FileJournal is a Journal kept in a file of JSON lines, synced after every entry.
+// It records values of the types registered with RegisterJournalType.
+type FileJournal struct {
+	lock    sync.Mutex
+	file    *os.File
+	entries map[journalKey]journalEntry
+}
+
+// OpenFileJournal opens the journal at path, creating it if needed and loading the
+// entries of an earlier run. An entry cut short by a crash is discarded; one that
+// can't be replayed is an error.
+func OpenFileJournal(path string) (*FileJournal, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("opening journal: %w", err)
+	}
+	j := &FileJournal{file: file, entries: make(map[journalKey]journalEntry)}
+	var good int64
+	r := bufio.NewReader(file)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("reading journal: %w", err)
+		}
+		var entry journalEntry
+		if json.Unmarshal(bytes.TrimSpace(line), &entry) != nil {
+			break
+		}
+		if _, err := entry.decode(); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("reading journal entry %d of session %q: %w", entry.Seq, entry.Session, err)
+		}
+		j.entries[journalKey{entry.Session, entry.Seq, entry.Peer}] = entry
+		good += int64(len(line))
+	}
+	// drop whatever follows the last whole entry, and append after it
+	if err := file.Truncate(good); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("truncating journal: %w", err)
+	}
+	if _, err := file.Seek(good, io.SeekStart); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("seeking journal: %w", err)
+	}
+	return j, nil
+}
+
+func (j *FileJournal) Lookup(session string, seq uint64, peer string) (interface{}, bool) {
+	j.lock.Lock()
+	entry, ok := j.entries[journalKey{session, seq, peer}]
+	j.lock.Unlock()
+	if !ok {
+		return nil, false
+	}
+	// checked when the entry was loaded or recorded
+	value, _ := entry.decode()
+	return value, true
+}
+
+func (j *FileJournal) Record(session string, seq uint64, peer string, value interface{}) error {
+	entry := journalEntry{Session: session, Seq: seq, Peer: peer}
+	if value != nil {
+		entry.Type = journalTypeName(reflect.TypeOf(value))
+		journalTypes.lock.RLock()
+		_, ok := journalTypes.byName[entry.Type]
+		journalTypes.lock.RUnlock()
+		if !ok {
+			return fmt.Errorf("type %s isn't registered with RegisterJournalType", entry.Type)
+		}
+	}
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("encoding journal entry: %w", err)
+	}
+	entry.Value = raw
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("encoding journal entry: %w", err)
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("writing journal: %w", err)
+	}
+	if err := j.file.Sync(); err != nil {
+		return fmt.Errorf("syncing journal: %w", err)
+	}
+	j.entries[journalKey{session, seq, peer}] = entry
+	return nil
+}
+
+// Close closes the journal file.
+func (j *FileJournal) Close() error {
+	return j.file.Close()
+}
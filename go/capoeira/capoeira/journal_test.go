@@ -0,0 +1,146 @@
+package capoeira
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+type quote struct {
+	Title string
+	Price int
+}
+
+func init() {
+	RegisterJournalType(quote{})
+}
+
+type journalChoreography struct {
+	quotes *atomic.Int32
+}
+
+func (c journalChoreography) Run(op ChoreoOp) interface{} {
+	q := op.Locally(Seller{}, func() interface{} {
+		c.quotes.Add(1)
+		return quote{Title: "TAPL", Price: 100}
+	})
+	quoteAtBuyer := op.Comm(Seller{}, Buyer{}, q)
+	return op.Locally(Buyer{}, func() interface{} { return quoteAtBuyer.Value.(quote).Price }).Value
+}
+
+func TestJournalResumesWithoutRepeating(t *testing.T) {
+	dir := t.TempDir()
+	transport := NewChannelTransport([]string{Seller{}.Name(), Buyer{}.Name()})
+	choreo := journalChoreography{quotes: new(atomic.Int32)}
+	run := func(loc Location, session string) interface{} {
+		journal, err := OpenFileJournal(filepath.Join(dir, loc.Name()+".journal"))
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		defer journal.Close()
+		p := NewProjector(loc, transport)
+		p.Session = session
+		p.Journal = journal
+		return p.EppAndRun(choreo)
+	}
+
+	go run(Seller{}, "journal-1")
+	if got := run(Buyer{}, "journal-1"); got != 100 {
+		t.Fatalf("expected 100 at buyer, got %v", got)
+	}
+
+	// run again at each location alone: everything comes from the journal
+	run(Seller{}, "journal-1")
+	if n := transport.mailbox(Seller{}.Name(), Buyer{}.Name()).len(); n != 0 {
+		t.Errorf("expected the resumed seller not to send again, got %d messages", n)
+	}
+	if got := run(Buyer{}, "journal-1"); got != 100 {
+		t.Errorf("expected 100 at resumed buyer, got %v", got)
+	}
+	if n := choreo.quotes.Load(); n != 1 {
+		t.Errorf("expected the seller to quote once, got %d", n)
+	}
+}
+
+func TestJournalIgnoresOtherSessions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seller.journal")
+	journal, err := OpenFileJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := journal.Record("journal-1", 1, "", 100); err != nil {
+		t.Fatal(err)
+	}
+	journal.Close()
+
+	journal, err = OpenFileJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	if val, ok := journal.Lookup("journal-1", 1, ""); !ok || val != 100 {
+		t.Errorf("expected 100 recorded for journal-1, got %v, %v", val, ok)
+	}
+	if val, ok := journal.Lookup("journal-2", 1, ""); ok {
+		t.Errorf("expected nothing recorded for journal-2, got %v", val)
+	}
+}
+
+func TestJournalReplaysRecordedTypes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "buyer.journal")
+	journal, err := OpenFileJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := quote{Title: "TAPL", Price: 100}
+	if err := journal.Record("journal-1", 2, Seller{}.Name(), want); err != nil {
+		t.Fatal(err)
+	}
+	type unregistered struct{ Price int }
+	if err := journal.Record("journal-1", 3, "", unregistered{100}); err == nil {
+		t.Errorf("expected recording a type that isn't registered to fail")
+	}
+	journal.Close()
+
+	journal, err = OpenFileJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	val, ok := journal.Lookup("journal-1", 2, Seller{}.Name())
+	if got, isQuote := val.(quote); !ok || !isQuote || got != want {
+		t.Errorf("expected %#v replayed, got %#v", want, val)
+	}
+}
+
+type unjournaledChoreography struct{}
+
+func (unjournaledChoreography) Run(op ChoreoOp) interface{} {
+	return op.Locally(Seller{}, func() interface{} { return make(chan int) }).Value
+}
+
+func TestJournalFailureAbortsRun(t *testing.T) {
+	journal, err := OpenFileJournal(filepath.Join(t.TempDir(), "seller.journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	p := NewProjector(Seller{}, NewChannelTransport([]string{Seller{}.Name(), Buyer{}.Name()}))
+	p.Session = "journal-1"
+	p.Journal = journal
+	if _, err := p.EppAndRunContext(context.Background(), unjournaledChoreography{}); err == nil || !strings.Contains(err.Error(), "failed to journal") {
+		t.Errorf("expected the run to abort on the journal's error, got %v", err)
+	}
+}
+
+func TestRegisterJournalTypeRejectsUnexportedFields(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected registering a struct with unexported fields to panic")
+		}
+	}()
+	RegisterJournalType(ParkingSpace{})
+}
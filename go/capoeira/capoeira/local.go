@@ -1,46 +1,129 @@
 package capoeira
 
 import (
+	"context"
+	"fmt"
+	"log/slog"
 	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/propagation"
 )
 
-// ChannelTransport implements Transport for two parties using Go channels.
+// ChannelTransport implements Transport for in-process parties using in-memory queues.
 type ChannelTransport struct {
-	locations []string
-	channels  map[string]chan interface{}
-	lock      sync.RWMutex
+	members *Membership
+	// mailbox keys are of the form "from->to"
+	mailboxes map[string]*mailbox
+	capacity  int
+	lock      sync.Mutex
+	// Logger traces messages at debug level; it defaults to DefaultLogger.
+	Logger *slog.Logger
+	// Metrics, if set, counts messages per (from, to) pair, and tracks how full their
+	// queues are. Messages are not encoded, so no bytes are counted.
+	Metrics *Metrics
 }
 
-func NewChannelTransport(parties []string) *ChannelTransport {
-	channels := make(map[string]chan interface{})
-	for _, party := range parties {
-		channels[party] = make(chan interface{}, 1)
+// ChannelOption configures a ChannelTransport.
+type ChannelOption func(*ChannelTransport)
+
+// WithCapacity sets how many messages from one location to another can be queued
+// before the sender waits for the receiver, or Unbounded so it never waits. The
+// default is 1.
+func WithCapacity(n int) ChannelOption {
+	return func(t *ChannelTransport) {
+		t.capacity = n
 	}
-	return &ChannelTransport{
-		locations: parties,
-		channels:  channels,
+}
+
+// message is a value in flight along with its propagated trace context.
+type message struct {
+	data  interface{}
+	trace propagation.MapCarrier
+	// size is the number of encoded bytes the message arrived as, if it was encoded.
+	size int
+}
+
+func NewChannelTransport(parties []string, opts ...ChannelOption) *ChannelTransport {
+	t := &ChannelTransport{
+		members:   NewMembership(parties...),
+		mailboxes: make(map[string]*mailbox),
+		capacity:  1,
+		Logger:    DefaultLogger(),
 	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
+// mailbox returns the queue for messages from one location to another, creating it if needed.
+func (t *ChannelTransport) mailbox(from, to string) *mailbox {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	key := from + "->" + to
+	mb, ok := t.mailboxes[key]
+	if !ok {
+		mb = newMailbox(t.capacity)
+		t.mailboxes[key] = mb
+	}
+	return mb
 }
 
 func (t *ChannelTransport) Send(from, to string, data interface{}) {
-	t.lock.RLock()
-	ch, ok := t.channels[to]
-	t.lock.RUnlock()
-	if ok {
-		ch <- data
+	if err := t.SendContext(context.Background(), from, to, data); err != nil {
+		t.Logger.Error("send failed", "location", from, "peer", to, "err", err)
+	}
+}
+
+func (t *ChannelTransport) SendContext(ctx context.Context, from, to string, data interface{}) error {
+	if !t.members.Contains(to) {
+		return fmt.Errorf("%s is not a member", to)
+	}
+	msg := message{data: data, trace: propagation.MapCarrier{}}
+	InjectTrace(ctx, msg.trace)
+	t.Logger.Debug("sending", "location", from, "peer", to, "data", data)
+	depth, blocked, err := t.mailbox(from, to).put(ctx, msg)
+	if blocked {
+		t.Metrics.ObserveBlocked(from, to)
 	}
+	t.Metrics.ObserveSend(from, to, 0, err)
+	if err == nil {
+		t.Metrics.ObserveQueue(from, to, depth)
+	}
+	return err
 }
 
 func (t *ChannelTransport) Receive(from, at string) interface{} {
-	t.lock.RLock()
-	ch, ok := t.channels[at]
-	t.lock.RUnlock()
-	if ok {
-		return <-ch
+	val, _, _ := t.ReceiveContext(context.Background(), from, at)
+	return val
+}
+
+func (t *ChannelTransport) ReceiveContext(ctx context.Context, from, at string) (interface{}, context.Context, error) {
+	if !t.members.Contains(at) {
+		return nil, ctx, fmt.Errorf("%s is not a member", at)
 	}
-	return nil
+	start := time.Now()
+	msg, depth, err := t.mailbox(from, at).take(ctx)
+	if err != nil {
+		return nil, ctx, err
+	}
+	t.Metrics.ObserveReceive(from, at, 0, start)
+	t.Metrics.ObserveQueue(from, at, depth)
+	t.Logger.Debug("received", "location", at, "peer", from, "data", msg.data)
+	return msg.data, ExtractTrace(ctx, msg.trace), nil
 }
 
 func (t *ChannelTransport) Locations() []string {
-	return t.locations
+	return t.members.View().Locations
+}
+
+// Membership returns the locations of the transport, to add or remove some.
+func (t *ChannelTransport) Membership() *Membership {
+	return t.members
+}
+
+// Codec is "go": messages are handed over as the values sent.
+func (t *ChannelTransport) Codec() string {
+	return "go"
 }
@@ -0,0 +1,247 @@
+// Package locsafety defines an analyzer that reports Located values read inside a
+// Locally closure for another location, and branches on Located values outside Locally.
+package locsafety
+
+import (
+	"go/ast"
+	"go/types"
+	"strings"
+
+	"golang.org/x/tools/go/analysis"
+	"golang.org/x/tools/go/analysis/passes/inspect"
+	"golang.org/x/tools/go/ast/inspector"
+	"golang.org/x/tools/go/types/typeutil"
+)
+
+var Analyzer = &analysis.Analyzer{
+	Name:     "locsafety",
+	Doc:      "check that Located values are only read at their own location",
+	Requires: []*analysis.Analyzer{inspect.Analyzer},
+	Run:      run,
+}
+
+func run(pass *analysis.Pass) (interface{}, error) {
+	insp := pass.ResultOf[inspect.Analyzer].(*inspector.Inspector)
+
+	// first pass: record where each Located variable lives
+	locations := make(map[types.Object]types.Type)
+	ambiguous := make(map[types.Object]bool)
+	record := func(lhs ast.Expr, rhs ast.Expr) {
+		id, ok := lhs.(*ast.Ident)
+		if !ok || id.Name == "_" {
+			return
+		}
+		obj := pass.TypesInfo.ObjectOf(id)
+		if obj == nil || !isLocated(obj.Type()) {
+			return
+		}
+		loc := locationOf(pass, rhs)
+		if loc == nil {
+			ambiguous[obj] = true
+			return
+		}
+		if prev, ok := locations[obj]; ok && !types.Identical(prev, loc) {
+			ambiguous[obj] = true
+		}
+		locations[obj] = loc
+	}
+	insp.Preorder([]ast.Node{(*ast.AssignStmt)(nil), (*ast.ValueSpec)(nil)}, func(n ast.Node) {
+		switch n := n.(type) {
+		case *ast.AssignStmt:
+			if len(n.Lhs) == len(n.Rhs) {
+				for i := range n.Lhs {
+					record(n.Lhs[i], n.Rhs[i])
+				}
+			}
+		case *ast.ValueSpec:
+			if len(n.Names) == len(n.Values) {
+				for i := range n.Names {
+					record(n.Names[i], n.Values[i])
+				}
+			}
+		}
+	})
+	for obj := range ambiguous {
+		delete(locations, obj)
+	}
+
+	// second pass: check Locally closures and branches outside them
+	insp.WithStack([]ast.Node{(*ast.CallExpr)(nil), (*ast.IfStmt)(nil), (*ast.SwitchStmt)(nil), (*ast.ForStmt)(nil)}, func(n ast.Node, push bool, stack []ast.Node) bool {
+		if !push {
+			return true
+		}
+		switch n := n.(type) {
+		case *ast.CallExpr:
+			if choreoMethod(pass, n) != "Locally" || len(n.Args) != 2 {
+				return true
+			}
+			at := pass.TypesInfo.TypeOf(n.Args[0])
+			body, ok := n.Args[1].(*ast.FuncLit)
+			if !ok || at == nil {
+				return true
+			}
+			ast.Inspect(body.Body, func(n ast.Node) bool {
+				id, ok := valueRead(n)
+				if !ok {
+					return true
+				}
+				obj := pass.TypesInfo.ObjectOf(id)
+				loc, ok := locations[obj]
+				if ok && !types.Identical(loc, at) {
+					pass.Reportf(n.Pos(), "%s is located at %s but read inside Locally(%s): it is nil there",
+						id.Name, typeName(loc), typeName(at))
+				}
+				return true
+			})
+		case *ast.IfStmt:
+			checkBranch(pass, n.Cond, stack)
+		case *ast.SwitchStmt:
+			checkBranch(pass, n.Tag, stack)
+		case *ast.ForStmt:
+			checkBranch(pass, n.Cond, stack)
+		}
+		return true
+	})
+	return nil, nil
+}
+
+// checkBranch reports reads of a Located value in cond unless cond sits inside a Locally closure.
+func checkBranch(pass *analysis.Pass, cond ast.Expr, stack []ast.Node) {
+	if cond == nil || insideLocally(pass, stack) || !choreographic(pass, stack) {
+		return
+	}
+	ast.Inspect(cond, func(n ast.Node) bool {
+		if _, isFunc := n.(*ast.FuncLit); isFunc {
+			return false
+		}
+		id, ok := valueRead(n)
+		if !ok || !isLocated(pass.TypesInfo.TypeOf(id)) {
+			return true
+		}
+		pass.Reportf(n.Pos(), "branching on %s outside Locally: Broadcast it first so every location takes the same branch", types.ExprString(n.(ast.Expr)))
+		return true
+	})
+}
+
+// insideLocally reports whether the innermost function on the stack is a Locally closure.
+func insideLocally(pass *analysis.Pass, stack []ast.Node) bool {
+	for i := len(stack) - 1; i > 0; i-- {
+		lit, ok := stack[i].(*ast.FuncLit)
+		if !ok {
+			continue
+		}
+		call, ok := stack[i-1].(*ast.CallExpr)
+		return ok && choreoMethod(pass, call) == "Locally" && len(call.Args) == 2 && call.Args[1] == lit
+	}
+	return false
+}
+
+// choreographic reports whether the innermost function on the stack takes a ChoreoOp.
+func choreographic(pass *analysis.Pass, stack []ast.Node) bool {
+	for i := len(stack) - 1; i >= 0; i-- {
+		var typ *ast.FuncType
+		switch fn := stack[i].(type) {
+		case *ast.FuncLit:
+			typ = fn.Type
+		case *ast.FuncDecl:
+			typ = fn.Type
+		default:
+			continue
+		}
+		for _, field := range typ.Params.List {
+			if isCapoeira(pass.TypesInfo.TypeOf(field.Type), "ChoreoOp", "ProjectorChoreoOp") {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// locationOf returns the type of the location an expression producing a Located lives at, if known.
+func locationOf(pass *analysis.Pass, expr ast.Expr) types.Type {
+	switch e := ast.Unparen(expr).(type) {
+	case *ast.CallExpr:
+		switch choreoMethod(pass, e) {
+		case "Locally":
+			if len(e.Args) > 0 {
+				return pass.TypesInfo.TypeOf(e.Args[0])
+			}
+		case "Comm", "CommAsync", "CommStream":
+			if len(e.Args) > 1 {
+				return pass.TypesInfo.TypeOf(e.Args[1])
+			}
+		}
+	case *ast.CompositeLit:
+		if !isLocated(pass.TypesInfo.TypeOf(e)) {
+			return nil
+		}
+		for _, elt := range e.Elts {
+			kv, ok := elt.(*ast.KeyValueExpr)
+			if !ok {
+				continue
+			}
+			if key, ok := kv.Key.(*ast.Ident); ok && key.Name == "Location" {
+				if t := pass.TypesInfo.TypeOf(kv.Value); t != nil && !types.IsInterface(t) {
+					return t
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// choreoMethod returns the name of the ChoreoOp method called by call, or "".
+func choreoMethod(pass *analysis.Pass, call *ast.CallExpr) string {
+	fn, ok := typeutil.Callee(pass.TypesInfo, call).(*types.Func)
+	if !ok {
+		return ""
+	}
+	recv := fn.Type().(*types.Signature).Recv()
+	if recv == nil || !isCapoeira(recv.Type(), "ChoreoOp", "ProjectorChoreoOp") {
+		return ""
+	}
+	return fn.Name()
+}
+
+// valueRead matches x.Value and x.Get where x is an identifier.
+func valueRead(n ast.Node) (*ast.Ident, bool) {
+	sel, ok := n.(*ast.SelectorExpr)
+	if !ok || (sel.Sel.Name != "Value" && sel.Sel.Name != "Get") {
+		return nil, false
+	}
+	id, ok := sel.X.(*ast.Ident)
+	return id, ok
+}
+
+func isLocated(t types.Type) bool {
+	return isCapoeira(t, "Located")
+}
+
+// isCapoeira reports whether t (or what it points to) is one of the named capoeira types.
+func isCapoeira(t types.Type, names ...string) bool {
+	if t == nil {
+		return false
+	}
+	if ptr, ok := t.(*types.Pointer); ok {
+		t = ptr.Elem()
+	}
+	named, ok := t.(*types.Named)
+	if !ok || named.Obj().Pkg() == nil {
+		return false
+	}
+	path := named.Obj().Pkg().Path()
+	if path != "capoeira" && !strings.HasSuffix(path, "/capoeira") {
+		return false
+	}
+	for _, name := range names {
+		if named.Obj().Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+func typeName(t types.Type) string {
+	return types.TypeString(t, func(*types.Package) string { return "" })
+}
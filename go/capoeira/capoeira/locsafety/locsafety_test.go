@@ -0,0 +1,12 @@
+package locsafety_test
+
+import (
+	"testing"
+
+	"github.com/danielc-lh/scripts/capoeira/locsafety"
+	"golang.org/x/tools/go/analysis/analysistest"
+)
+
+func TestAnalyzer(t *testing.T) {
+	analysistest.Run(t, analysistest.TestData(), locsafety.Analyzer, "a")
+}
@@ -0,0 +1,61 @@
+package a
+
+import "github.com/danielc-lh/scripts/capoeira"
+
+type Buyer struct{}
+
+func (Buyer) Name() string { return "Buyer" }
+
+type Seller struct{}
+
+func (Seller) Name() string { return "Seller" }
+
+type Choreo struct {
+	Title capoeira.Located
+}
+
+func (c Choreo) Run(op capoeira.ChoreoOp) interface{} {
+	titleAtSeller := op.Comm(Buyer{}, Seller{}, c.Title)
+	priceAtSeller := op.Locally(Seller{}, func() interface{} {
+		return len(titleAtSeller.Value.(string))
+	})
+	op.Locally(Buyer{}, func() interface{} {
+		return titleAtSeller.Value // want `titleAtSeller is located at Seller but read inside Locally\(Buyer\): it is nil there`
+	})
+	priceAtBuyer := op.Comm(Seller{}, Buyer{}, priceAtSeller)
+	op.Locally(Buyer{}, func() interface{} {
+		if priceAtBuyer.Value != nil {
+			return priceAtBuyer.Value
+		}
+		return c.Title.Value
+	})
+	budget := capoeira.Located{Value: 100, Location: Buyer{}}
+	op.Locally(Seller{}, func() interface{} {
+		return budget.Value // want `budget is located at Buyer but read inside Locally\(Seller\)`
+	})
+
+	quoteAtBuyer := op.CommAsync(Seller{}, Buyer{}, priceAtSeller)
+	op.Locally(Seller{}, func() interface{} {
+		return quoteAtBuyer.Get() // want `quoteAtBuyer is located at Buyer but read inside Locally\(Seller\)`
+	})
+
+	if priceAtBuyer.Value != nil { // want `branching on priceAtBuyer.Value outside Locally`
+		op.Locally(Buyer{}, func() interface{} { return nil })
+	}
+	switch quoteAtBuyer.Get() { // want `branching on quoteAtBuyer.Get outside Locally`
+	case nil:
+		return nil
+	}
+	if op.Broadcast(Seller{}, priceAtSeller) != nil {
+		return nil
+	}
+	return nil
+}
+
+// helpers without a ChoreoOp are not choreographies
+func describe(l capoeira.Located) string {
+	if l.Value == nil {
+		return "remote"
+	}
+	return "local"
+}
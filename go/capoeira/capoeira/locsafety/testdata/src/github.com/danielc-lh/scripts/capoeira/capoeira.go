@@ -0,0 +1,19 @@
+package capoeira
+
+type Location interface {
+	Name() string
+}
+
+type Located struct {
+	Value    interface{}
+	Location Location
+}
+
+func (l Located) Get() interface{} { return l.Value }
+
+type ChoreoOp interface {
+	Locally(location Location, computation func() interface{}) Located
+	Comm(sender, receiver Location, data Located) Located
+	CommAsync(sender, receiver Location, data Located) Located
+	Broadcast(sender Location, data Located) interface{}
+}
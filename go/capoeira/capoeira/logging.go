@@ -0,0 +1,115 @@
+package capoeira
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// LogEnv names the environment variable that sets log levels, as a default level
+// and optional per-location overrides, e.g. "warn,printer=debug".
+const LogEnv = "CAPOEIRA_LOG"
+
+var defaultLogger = sync.OnceValue(func() *slog.Logger {
+	return slog.New(NewLevelHandler(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}), os.Getenv(LogEnv)))
+})
+
+// DefaultLogger returns the logger used by projectors and transports that aren't given one.
+// It writes text to stderr at the levels set in LogEnv, warn by default.
+func DefaultLogger() *slog.Logger {
+	return defaultLogger()
+}
+
+// LevelHandler filters records by level, using a per-location level when the record
+// (or the logger it came from) has a "location" attribute.
+type LevelHandler struct {
+	inner    slog.Handler
+	def      slog.Level
+	levels   map[string]slog.Level
+	location string
+}
+
+// NewLevelHandler wraps inner with the levels in spec, formatted as for LogEnv.
+// Unparseable entries are ignored.
+func NewLevelHandler(inner slog.Handler, spec string) *LevelHandler {
+	h := &LevelHandler{inner: inner, def: slog.LevelWarn, levels: make(map[string]slog.Level)}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		var level slog.Level
+		location, name, found := strings.Cut(part, "=")
+		if !found {
+			if level.UnmarshalText([]byte(part)) == nil {
+				h.def = level
+			}
+			continue
+		}
+		if level.UnmarshalText([]byte(name)) == nil {
+			h.levels[location] = level
+		}
+	}
+	return h
+}
+
+// level returns the minimum level for a location, or for its role if it's an instance of one.
+func (h *LevelHandler) level(location string) slog.Level {
+	if level, ok := h.levels[location]; ok {
+		return level
+	}
+	if role, _, ok := strings.Cut(location, "/"); ok {
+		if level, ok := h.levels[role]; ok {
+			return level
+		}
+	}
+	return h.def
+}
+
+func (h *LevelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	if h.location != "" {
+		return level >= h.level(h.location) && h.inner.Enabled(ctx, level)
+	}
+	// the location may still come with the record, so allow anything some location allows
+	lowest := h.def
+	for _, l := range h.levels {
+		if l < lowest {
+			lowest = l
+		}
+	}
+	return level >= lowest && h.inner.Enabled(ctx, level)
+}
+
+func (h *LevelHandler) Handle(ctx context.Context, r slog.Record) error {
+	location := h.location
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == "location" {
+			location = a.Value.String()
+			return false
+		}
+		return true
+	})
+	if r.Level < h.level(location) {
+		return nil
+	}
+	return h.inner.Handle(ctx, r)
+}
+
+func (h *LevelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	c.inner = h.inner.WithAttrs(attrs)
+	for _, a := range attrs {
+		if a.Key == "location" {
+			c.location = a.Value.String()
+		}
+	}
+	return &c
+}
+
+func (h *LevelHandler) WithGroup(name string) slog.Handler {
+	c := *h
+	c.inner = h.inner.WithGroup(name)
+	return &c
+}
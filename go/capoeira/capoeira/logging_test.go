@@ -0,0 +1,70 @@
+package capoeira
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// levelLogger returns a logger filtered by spec, and the buffer it writes to.
+func levelLogger(spec string) (*slog.Logger, *bytes.Buffer) {
+	var buf bytes.Buffer
+	inner := slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})
+	return slog.New(NewLevelHandler(inner, spec)), &buf
+}
+
+func TestLevelHandlerFiltersByLocation(t *testing.T) {
+	logger, buf := levelLogger("warn,printer=debug,Buyer=info")
+	logger.Info("default info", "location", "seller")
+	logger.Warn("default warn", "location", "seller")
+	logger.Debug("printer debug", "location", "printer")
+	logger.Debug("instance debug", "location", "Buyer/b-1")
+	logger.Info("instance info", "location", "Buyer/b-1")
+	logger.Info("no location")
+
+	got := buf.String()
+	for _, want := range []string{"default warn", "printer debug", "instance info"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected %q to be logged, got:\n%s", want, got)
+		}
+	}
+	for _, unwanted := range []string{"default info", "instance debug", "no location"} {
+		if strings.Contains(got, unwanted) {
+			t.Errorf("expected %q to be filtered out, got:\n%s", unwanted, got)
+		}
+	}
+}
+
+func TestLevelHandlerKeepsLocationAcrossWith(t *testing.T) {
+	logger, buf := levelLogger("error,printer=debug")
+	printer := logger.With("location", "printer")
+	printer.Debug("with attrs")
+	printer.WithGroup("op").Debug("with group", "seq", 1)
+	logger.With("peer", "printer").Debug("peer only")
+
+	got := buf.String()
+	for _, want := range []string{"with attrs", "with group"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected %q to be logged at the printer's level, got:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "peer only") {
+		t.Errorf("expected a record without a location to use the default level, got:\n%s", got)
+	}
+}
+
+func TestLevelHandlerIgnoresBadSpec(t *testing.T) {
+	logger, buf := levelLogger("loud, printer=shout, =debug,,seller=info")
+	logger.Info("default info", "location", "printer")
+	logger.Warn("default warn", "location", "printer")
+	logger.Info("seller info", "location", "seller")
+
+	got := buf.String()
+	if strings.Contains(got, "default info") || !strings.Contains(got, "default warn") {
+		t.Errorf("expected unparseable entries to leave the default at warn, got:\n%s", got)
+	}
+	if !strings.Contains(got, "seller info") {
+		t.Errorf("expected the valid override to apply, got:\n%s", got)
+	}
+}
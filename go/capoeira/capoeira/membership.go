@@ -0,0 +1,101 @@
+package capoeira
+
+import (
+	"slices"
+	"sync"
+)
+
+// Membership is the versioned set of locations of a transport. A run, and later runs
+// of its Session in the same process, keep the version it started with.
+type Membership struct {
+	lock     sync.Mutex
+	current  View
+	sessions map[string]*sessionView
+}
+
+// View is a version of a Membership.
+type View struct {
+	Version   uint64
+	Locations []string
+}
+
+type sessionView struct {
+	view View
+	runs int
+}
+
+func NewMembership(locations ...string) *Membership {
+	return &Membership{
+		current:  View{Version: 1, Locations: slices.Clone(locations)},
+		sessions: make(map[string]*sessionView),
+	}
+}
+
+// AddLocation adds a location, returning the new version. Adding a member changes nothing.
+func (m *Membership) AddLocation(location string) uint64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !slices.Contains(m.current.Locations, location) {
+		m.current = View{Version: m.current.Version + 1, Locations: append(slices.Clone(m.current.Locations), location)}
+	}
+	return m.current.Version
+}
+
+// RemoveLocation removes a location, returning the new version.
+func (m *Membership) RemoveLocation(location string) uint64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if i := slices.Index(m.current.Locations, location); i >= 0 {
+		m.current = View{Version: m.current.Version + 1, Locations: slices.Delete(slices.Clone(m.current.Locations), i, i+1)}
+	}
+	return m.current.Version
+}
+
+// View returns the current version of the membership.
+func (m *Membership) View() View {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.current
+}
+
+// Contains reports whether location is a member now.
+func (m *Membership) Contains(location string) bool {
+	return slices.Contains(m.View().Locations, location)
+}
+
+// Join returns the view a run in session sees, and a func to call when the run ends.
+// Runs without a session see the current view.
+func (m *Membership) Join(session string) (View, func()) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if session == "" {
+		return m.current, func() {}
+	}
+	sv, ok := m.sessions[session]
+	if !ok {
+		sv = &sessionView{view: m.current}
+		m.sessions[session] = sv
+	}
+	sv.runs++
+	return sv.view, func() {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		if sv.runs--; sv.runs == 0 {
+			delete(m.sessions, session)
+		}
+	}
+}
+
+// MembershipTransport is a Transport whose locations are a Membership.
+type MembershipTransport interface {
+	Transport
+	Membership() *Membership
+}
+
+// membershipOf returns the membership of t, if it has one.
+func membershipOf(t Transport) *Membership {
+	if mt, ok := t.(MembershipTransport); ok {
+		return mt.Membership()
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package capoeira
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+type broadcastChoreography struct{}
+
+func (broadcastChoreography) Run(op ChoreoOp) interface{} {
+	return op.Broadcast(ParkingAuthority{}, op.Locally(ParkingAuthority{}, func() interface{} { return "ticket" }))
+}
+
+func TestLocationJoinsBetweenRuns(t *testing.T) {
+	transport := NewChannelTransport([]string{Ticketer{}.Name(), ParkingAuthority{}.Name()})
+	runAll(transport, broadcastChoreography{}, Ticketer{}, ParkingAuthority{})
+
+	transport.Membership().AddLocation(Printer{}.Name())
+	results := runAll(transport, broadcastChoreography{}, Ticketer{}, ParkingAuthority{}, Printer{})
+	if results[Printer{}.Name()] != "ticket" {
+		t.Errorf("expected the new printer to receive the broadcast, got %v", results[Printer{}.Name()])
+	}
+}
+
+func TestSessionKeepsItsView(t *testing.T) {
+	m := NewMembership(Ticketer{}.Name(), ParkingAuthority{}.Name())
+	first, leave := m.Join("session-1")
+	if version := m.AddLocation(Printer{}.Name()); version != first.Version+1 {
+		t.Errorf("expected version %d after a join, got %d", first.Version+1, version)
+	}
+	second, leaveAgain := m.Join("session-1")
+	if second.Version != first.Version || slices.Contains(second.Locations, Printer{}.Name()) {
+		t.Errorf("expected the session to keep version %d, got %+v", first.Version, second)
+	}
+	leave()
+	leaveAgain()
+	if next, _ := m.Join("session-1"); !slices.Contains(next.Locations, Printer{}.Name()) {
+		t.Errorf("expected a new run of the session to see the printer, got %+v", next)
+	}
+}
+
+func TestRemovedLocationIsNotReachable(t *testing.T) {
+	transport := NewChannelTransport([]string{Ticketer{}.Name(), Printer{}.Name()})
+	transport.Membership().RemoveLocation(Printer{}.Name())
+	ctx := context.Background()
+	if err := transport.SendContext(ctx, Ticketer{}.Name(), Printer{}.Name(), "ticket"); err == nil {
+		t.Error("expected a send to a removed location to fail")
+	}
+	if _, _, err := transport.ReceiveContext(ctx, Ticketer{}.Name(), Printer{}.Name()); err == nil {
+		t.Error("expected a receive at a removed location to fail")
+	}
+}
@@ -0,0 +1,124 @@
+package capoeira
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics records Prometheus metrics about the messages a transport sends and
+// receives, labelled by the (from, to) pair. A nil *Metrics records nothing.
+type Metrics struct {
+	Registry *prometheus.Registry
+
+	sent          *prometheus.CounterVec
+	received      *prometheus.CounterVec
+	sentBytes     *prometheus.CounterVec
+	receivedBytes *prometheus.CounterVec
+	sendFailures  *prometheus.CounterVec
+	sendRetries   *prometheus.CounterVec
+	receiveWait   *prometheus.HistogramVec
+	queueDepth    *prometheus.GaugeVec
+	blockedSends  *prometheus.CounterVec
+}
+
+// NewMetrics creates the transport metrics in a registry of their own.
+func NewMetrics() *Metrics {
+	labels := []string{"from", "to"}
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		sent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "capoeira_messages_sent_total",
+			Help: "Messages sent.",
+		}, labels),
+		received: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "capoeira_messages_received_total",
+			Help: "Messages received.",
+		}, labels),
+		sentBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "capoeira_message_bytes_sent_total",
+			Help: "Encoded bytes of messages sent.",
+		}, labels),
+		receivedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "capoeira_message_bytes_received_total",
+			Help: "Encoded bytes of messages received.",
+		}, labels),
+		sendFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "capoeira_send_failures_total",
+			Help: "Messages that could not be sent.",
+		}, labels),
+		sendRetries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "capoeira_send_retries_total",
+			Help: "Attempts at sending a message that failed and were retried.",
+		}, labels),
+		receiveWait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "capoeira_receive_wait_seconds",
+			Help:    "Time spent waiting in Receive for a message to arrive.",
+			Buckets: prometheus.ExponentialBuckets(0.0005, 4, 10),
+		}, labels),
+		queueDepth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "capoeira_queue_depth",
+			Help: "Messages queued for the receiver.",
+		}, labels),
+		blockedSends: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "capoeira_blocked_sends_total",
+			Help: "Messages whose sender waited for room in a full queue.",
+		}, labels),
+	}
+	m.Registry.MustRegister(m.sent, m.received, m.sentBytes, m.receivedBytes, m.sendFailures, m.sendRetries, m.receiveWait, m.queueDepth, m.blockedSends)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{})
+}
+
+// ObserveSend records a send of size encoded bytes, or its failure.
+func (m *Metrics) ObserveSend(from, to string, size int, err error) {
+	if m == nil {
+		return
+	}
+	if err != nil {
+		m.sendFailures.WithLabelValues(from, to).Inc()
+		return
+	}
+	m.sent.WithLabelValues(from, to).Inc()
+	m.sentBytes.WithLabelValues(from, to).Add(float64(size))
+}
+
+// ObserveRetry records a failed attempt at a send that is being retried.
+func (m *Metrics) ObserveRetry(from, to string) {
+	if m == nil {
+		return
+	}
+	m.sendRetries.WithLabelValues(from, to).Inc()
+}
+
+// ObserveReceive records a receive of size encoded bytes after waiting for it since start.
+func (m *Metrics) ObserveReceive(from, to string, size int, start time.Time) {
+	if m == nil {
+		return
+	}
+	m.received.WithLabelValues(from, to).Inc()
+	m.receivedBytes.WithLabelValues(from, to).Add(float64(size))
+	m.receiveWait.WithLabelValues(from, to).Observe(time.Since(start).Seconds())
+}
+
+// ObserveQueue records the number of messages queued from one location to another.
+func (m *Metrics) ObserveQueue(from, to string, depth int) {
+	if m == nil {
+		return
+	}
+	m.queueDepth.WithLabelValues(from, to).Set(float64(depth))
+}
+
+// ObserveBlocked records a send that waited for room in a full queue.
+func (m *Metrics) ObserveBlocked(from, to string) {
+	if m == nil {
+		return
+	}
+	m.blockedSends.WithLabelValues(from, to).Inc()
+}
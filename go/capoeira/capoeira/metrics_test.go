@@ -0,0 +1,80 @@
+package capoeira
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsCountMessagesPerPair(t *testing.T) {
+	authority, printer, ticketer := ParkingAuthority{}.Name(), Printer{}.Name(), Ticketer{}.Name()
+	transport := NewHTTPTransport([]string{authority, printer, ticketer}, WithPort(0), WithRetry(1, time.Millisecond))
+	defer transport.StopServer()
+
+	var wg sync.WaitGroup
+	for _, location := range []Location{ParkingAuthority{}, Printer{}, Ticketer{}} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := NewProjector(location, transport).EppAndRunContext(context.Background(), relayChoreography{}); err != nil {
+				t.Errorf("%s: %v", location.Name(), err)
+			}
+		}()
+	}
+	wg.Wait()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := transport.SendContext(ctx, ticketer, printer, "late"); err == nil {
+		t.Fatalf("expected a send on a cancelled context to fail")
+	}
+
+	m := transport.Metrics
+	for _, pair := range [][2]string{{authority, printer}, {printer, ticketer}} {
+		from, to := pair[0], pair[1]
+		if n := testutil.ToFloat64(m.sent.WithLabelValues(from, to)); n != 1 {
+			t.Errorf("expected 1 message sent from %s to %s, got %v", from, to, n)
+		}
+		if n := testutil.ToFloat64(m.received.WithLabelValues(from, to)); n != 1 {
+			t.Errorf("expected 1 message received from %s at %s, got %v", from, to, n)
+		}
+		sent, received := testutil.ToFloat64(m.sentBytes.WithLabelValues(from, to)), testutil.ToFloat64(m.receivedBytes.WithLabelValues(from, to))
+		if sent == 0 || sent != received {
+			t.Errorf("expected the bytes sent from %s to %s to match those received, got %v and %v", from, to, sent, received)
+		}
+		if n := testutil.ToFloat64(m.sendFailures.WithLabelValues(from, to)); n != 0 {
+			t.Errorf("expected no failed sends from %s to %s, got %v", from, to, n)
+		}
+	}
+	if n := testutil.ToFloat64(m.sendFailures.WithLabelValues(ticketer, printer)); n != 1 {
+		t.Errorf("expected 1 failed send from %s to %s, got %v", ticketer, printer, n)
+	}
+	if n := testutil.ToFloat64(m.sent.WithLabelValues(ticketer, printer)); n != 0 {
+		t.Errorf("expected the failed send not to count as sent, got %v", n)
+	}
+
+	resp, err := http.Get(transport.url("/metrics"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`capoeira_messages_sent_total{from="parking_authority",to="printer"} 1`,
+		`capoeira_messages_received_total{from="printer",to="ticketer"} 1`,
+		`capoeira_receive_wait_seconds_count{from="parking_authority",to="printer"} 1`,
+		`capoeira_send_failures_total{from="ticketer",to="printer"} 1`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("expected /metrics to expose %q, got:\n%s", want, body)
+		}
+	}
+}
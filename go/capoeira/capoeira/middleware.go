@@ -0,0 +1,319 @@
+package capoeira
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// Envelope is a message between two locations, as seen by middleware.
+type Envelope struct {
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Session string `json:"session,omitempty"`
+	// Header carries metadata added by middleware, such as trace context or signatures.
+	Header  map[string]string `json:"header,omitempty"`
+	Payload interface{}       `json:"payload"`
+}
+
+// EncodingHeader names the header listing, in order, the encodings applied to an
+// envelope's payload by middleware. It is empty while the payload is a plain value.
+const EncodingHeader = "encoding"
+
+// Encode replaces the payload with its JSON encoding, unless middleware already
+// encoded it, and returns the encoded bytes.
+func (e *Envelope) Encode() ([]byte, error) {
+	if e.Header[EncodingHeader] != "" {
+		return e.Bytes()
+	}
+	b, err := json.Marshal(e.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("encoding payload: %w", err)
+	}
+	if e.Header == nil {
+		e.Header = map[string]string{}
+	}
+	e.Header[EncodingHeader] = "json"
+	e.Payload = b
+	return b, nil
+}
+
+// Bytes returns the encoded payload. Bytes arrive as base64 text if the transport
+// carried the envelope as JSON.
+func (e *Envelope) Bytes() ([]byte, error) {
+	switch p := e.Payload.(type) {
+	case []byte:
+		return p, nil
+	case string:
+		b, err := base64.StdEncoding.DecodeString(p)
+		if err != nil {
+			return nil, fmt.Errorf("decoding payload bytes: %w", err)
+		}
+		e.Payload = b
+		return b, nil
+	}
+	return nil, fmt.Errorf("payload is not encoded: %T", e.Payload)
+}
+
+// PushEncoding replaces the encoded payload with b, the result of applying the
+// named encoding to it.
+func (e *Envelope) PushEncoding(name string, b []byte) {
+	e.Header[EncodingHeader] += "," + name
+	e.Payload = b
+}
+
+// PopEncoding returns the encoded payload, checking the named encoding was the last
+// one applied. The caller undoes it and puts the result back in Payload.
+func (e *Envelope) PopEncoding(name string) ([]byte, error) {
+	encoding := e.Header[EncodingHeader]
+	i := strings.LastIndex(encoding, ",")
+	if i < 0 || encoding[i+1:] != name {
+		return nil, fmt.Errorf("payload encoded as %q, expected %s", encoding, name)
+	}
+	b, err := e.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	e.Header[EncodingHeader] = encoding[:i]
+	return b, nil
+}
+
+// decode turns a payload left encoded as plain JSON back into a value.
+func (e *Envelope) decode() error {
+	switch e.Header[EncodingHeader] {
+	case "":
+		return nil
+	case "json":
+	default:
+		return fmt.Errorf("payload still encoded as %s", e.Header[EncodingHeader])
+	}
+	b, err := e.Bytes()
+	if err != nil {
+		return err
+	}
+	var value interface{}
+	if err := json.Unmarshal(b, &value); err != nil {
+		return fmt.Errorf("decoding payload: %w", err)
+	}
+	delete(e.Header, EncodingHeader)
+	e.Payload = value
+	return nil
+}
+
+// SendFunc delivers an envelope to its destination.
+type SendFunc func(ctx context.Context, env *Envelope) error
+
+// ReceiveFunc waits for the next envelope from one location at another.
+type ReceiveFunc func(ctx context.Context, from, at string) (*Envelope, error)
+
+// Middleware intercepts the envelopes passing through a transport built by Chain.
+// Either func may be nil to leave that direction alone.
+type Middleware struct {
+	Send    func(next SendFunc) SendFunc
+	Receive func(next ReceiveFunc) ReceiveFunc
+}
+
+// ChainTransport passes messages through a chain of middleware around another transport.
+type ChainTransport struct {
+	inner   Transport
+	send    SendFunc
+	receive ReceiveFunc
+}
+
+// Chain wraps t so every message passes through mw as an Envelope, the first
+// middleware seeing outgoing envelopes first and incoming ones last.
+func Chain(t Transport, mw ...Middleware) *ChainTransport {
+	c := &ChainTransport{inner: t}
+	c.send = c.sendInner
+	c.receive = c.receiveInner
+	for i := len(mw) - 1; i >= 0; i-- {
+		if mw[i].Send != nil {
+			c.send = mw[i].Send(c.send)
+		}
+		if mw[i].Receive != nil {
+			c.receive = mw[i].Receive(c.receive)
+		}
+	}
+	return c
+}
+
+func (c *ChainTransport) sendInner(ctx context.Context, env *Envelope) error {
+	if t, ok := c.inner.(ContextTransport); ok {
+		return t.SendContext(ctx, env.From, env.To, env)
+	}
+	c.inner.Send(env.From, env.To, env)
+	return nil
+}
+
+func (c *ChainTransport) receiveInner(ctx context.Context, from, at string) (*Envelope, error) {
+	var data interface{}
+	if t, ok := c.inner.(ContextTransport); ok {
+		var err error
+		if data, _, err = t.ReceiveContext(ctx, from, at); err != nil {
+			return nil, err
+		}
+	} else {
+		data = c.inner.Receive(from, at)
+	}
+	return toEnvelope(data)
+}
+
+// toEnvelope recovers an envelope from what the inner transport delivered, which
+// is a generic value if the transport encoded it on the way.
+func toEnvelope(data interface{}) (*Envelope, error) {
+	switch env := data.(type) {
+	case *Envelope:
+		return env, nil
+	case Envelope:
+		return &env, nil
+	case nil:
+		return nil, fmt.Errorf("no envelope received")
+	}
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("re-encoding envelope: %w", err)
+	}
+	env := &Envelope{}
+	if err := json.Unmarshal(raw, env); err != nil {
+		return nil, fmt.Errorf("decoding envelope: %w", err)
+	}
+	return env, nil
+}
+
+func (c *ChainTransport) Send(from, to string, data interface{}) {
+	if err := c.SendContext(context.Background(), from, to, data); err != nil {
+		DefaultLogger().Error("send failed", "location", from, "peer", to, "err", err)
+	}
+}
+
+func (c *ChainTransport) SendContext(ctx context.Context, from, to string, data interface{}) error {
+	env := &Envelope{
+		From:    from,
+		To:      to,
+		Session: SessionFromContext(ctx),
+		Header:  map[string]string{},
+		Payload: data,
+	}
+	InjectTrace(ctx, propagation.MapCarrier(env.Header))
+	return c.send(ctx, env)
+}
+
+func (c *ChainTransport) Receive(from, at string) interface{} {
+	val, _, err := c.ReceiveContext(context.Background(), from, at)
+	if err != nil {
+		DefaultLogger().Error("receive failed", "location", at, "peer", from, "err", err)
+	}
+	return val
+}
+
+func (c *ChainTransport) ReceiveContext(ctx context.Context, from, at string) (interface{}, context.Context, error) {
+	env, err := c.receive(ctx, from, at)
+	if err != nil {
+		return nil, ctx, err
+	}
+	if err := env.decode(); err != nil {
+		return nil, ctx, err
+	}
+	return env.Payload, ExtractTrace(ctx, propagation.MapCarrier(env.Header)), nil
+}
+
+func (c *ChainTransport) Locations() []string {
+	return c.inner.Locations()
+}
+
+// Membership returns the membership of the wrapped transport, if it has one.
+func (c *ChainTransport) Membership() *Membership {
+	return membershipOf(c.inner)
+}
+
+// Codec returns the codec of the wrapped transport, which carries the envelopes.
+func (c *ChainTransport) Codec() string {
+	return codecOf(c.inner)
+}
+
+// MiddlewareOption configures middleware such as Sign and Encrypt.
+type MiddlewareOption func(*middlewareConfig)
+
+type middlewareConfig struct {
+	logger    *slog.Logger
+	plaintext map[string]bool
+}
+
+// WithLogger sets the logger middleware reports dropped messages to; it defaults to DefaultLogger.
+func WithLogger(logger *slog.Logger) MiddlewareOption {
+	return func(c *middlewareConfig) {
+		c.logger = logger
+	}
+}
+
+// WithPlaintextLink lets Encrypt send messages between a and b in the clear when
+// either has no encryption key; sends on any other link without keys fail.
+func WithPlaintextLink(a, b string) MiddlewareOption {
+	return func(c *middlewareConfig) {
+		if c.plaintext == nil {
+			c.plaintext = make(map[string]bool)
+		}
+		c.plaintext[a+"->"+b], c.plaintext[b+"->"+a] = true, true
+	}
+}
+
+func newMiddlewareConfig(opts []MiddlewareOption) middlewareConfig {
+	c := middlewareConfig{logger: DefaultLogger()}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// LogMessages is middleware that logs every envelope at debug level.
+func LogMessages(logger *slog.Logger) Middleware {
+	return Middleware{
+		Send: func(next SendFunc) SendFunc {
+			return func(ctx context.Context, env *Envelope) error {
+				logger.Debug("sending", "location", env.From, "peer", env.To, "session", env.Session, "data", env.Payload)
+				return next(ctx, env)
+			}
+		},
+		Receive: func(next ReceiveFunc) ReceiveFunc {
+			return func(ctx context.Context, from, at string) (*Envelope, error) {
+				env, err := next(ctx, from, at)
+				if err == nil {
+					logger.Debug("received", "location", env.To, "peer", env.From, "session", env.Session, "data", env.Payload)
+				}
+				return env, err
+			}
+		},
+	}
+}
+
+type sessionKey struct{}
+
+// WithSession returns ctx carrying the session of a run, for envelopes sent under it.
+func WithSession(ctx context.Context, session string) context.Context {
+	return context.WithValue(ctx, sessionKey{}, session)
+}
+
+// SessionFromContext returns the session carried by ctx, if any.
+func SessionFromContext(ctx context.Context) string {
+	session, _ := ctx.Value(sessionKey{}).(string)
+	return session
+}
+
+type messageIDKey struct{}
+
+// WithMessageID returns ctx carrying the ID of a message about to be sent under it,
+// for transports that deduplicate messages by ID. Transports make up an ID otherwise.
+func WithMessageID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, messageIDKey{}, id)
+}
+
+// MessageIDFromContext returns the message ID carried by ctx, if any.
+func MessageIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(messageIDKey{}).(string)
+	return id
+}
@@ -0,0 +1,84 @@
+package capoeira
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+)
+
+// jsonTransport encodes messages as JSON on the way, like the network transports.
+type jsonTransport struct {
+	inner *ChannelTransport
+}
+
+func (t jsonTransport) Send(from, to string, data interface{}) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		panic(err)
+	}
+	t.inner.Send(from, to, b)
+}
+
+func (t jsonTransport) Receive(from, at string) interface{} {
+	var data interface{}
+	if err := json.Unmarshal(t.inner.Receive(from, at).([]byte), &data); err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func (t jsonTransport) Locations() []string {
+	return t.inner.Locations()
+}
+
+func TestChainPassesEnvelopeThroughMiddleware(t *testing.T) {
+	var lock sync.Mutex
+	var seen []Envelope
+	stamp := Middleware{
+		Send: func(next SendFunc) SendFunc {
+			return func(ctx context.Context, env *Envelope) error {
+				env.Header["stamp"] = env.From + "->" + env.To
+				return next(ctx, env)
+			}
+		},
+		Receive: func(next ReceiveFunc) ReceiveFunc {
+			return func(ctx context.Context, from, at string) (*Envelope, error) {
+				env, err := next(ctx, from, at)
+				if err == nil {
+					lock.Lock()
+					seen = append(seen, *env)
+					lock.Unlock()
+				}
+				return env, err
+			}
+		},
+	}
+	transport := Chain(jsonTransport{NewChannelTransport([]string{Seller{}.Name(), Buyer{}.Name()})}, stamp)
+
+	done := make(chan interface{})
+	go func() {
+		seller := NewProjector(Seller{}, transport)
+		seller.Session = "books-2"
+		done <- seller.EppAndRun(BooksellerChoreography{Title: seller.Remote(Buyer{}), Budget: seller.Remote(Buyer{})})
+	}()
+	buyer := NewProjector(Buyer{}, transport)
+	buyer.Session = "books-2"
+	decision := buyer.EppAndRun(BooksellerChoreography{Title: buyer.Local("TAPL"), Budget: buyer.Local(BUDGET)})
+
+	if decision != true || <-done != true {
+		t.Fatalf("expected both locations to decide to buy")
+	}
+	// two handshakes, then the title, price, decision and delivery date
+	if len(seen) != 6 {
+		t.Fatalf("expected 6 envelopes, got %d", len(seen))
+	}
+	for _, env := range seen {
+		if env.Session != "books-2" {
+			t.Errorf("expected session books-2, got %q", env.Session)
+		}
+		if env.Header["stamp"] != env.From+"->"+env.To {
+			t.Errorf("expected stamp %s->%s, got %q", env.From, env.To, env.Header["stamp"])
+		}
+	}
+}
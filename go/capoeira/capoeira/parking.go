@@ -34,12 +34,23 @@ func (t Printer) Name() string { return "printer" }
 // choreography
 type TicketingChoreography struct{}
 
+func init() {
+	RegisterChoreography(TicketingChoreography{}, ChoreographyInfo{
+		Name:        "Ticketing",
+		Locations:   []string{Ticketer{}.Name(), ParkingAuthority{}.Name(), Printer{}.Name()},
+		Version:     "1",
+		Description: "the ticketer shares the garage's spaces, the parking authority decides which are overdue, and the printer tickets them",
+	})
+}
+
 func getGarageState() interface{} {
 	return Garage{
 		spaces: []ParkingSpace{
 			{number: 1, occupied: false}, // empty
-			{number: 2, occupied: true, occupant: "Alice", startTime: time.Now(), duration: time.Hour},                       // full + paid
-			{number: 3, occupied: true, occupant: "Bob", startTime: time.Now().Add(-2 * time.Hour), duration: 1 * time.Hour}, // overdue
+			{number: 2, occupied: true, occupant: "Alice", startTime: time.Now(), duration: time.Hour},                            // full + paid
+			{number: 3, occupied: true, occupant: "Bob", startTime: time.Now().Add(-2 * time.Hour), duration: 1 * time.Hour},      // overdue
+			{number: 4, occupied: true, occupant: "Carol", startTime: time.Now().Add(-30 * time.Minute), duration: 2 * time.Hour}, // full + paid
+			{number: 5, occupied: true, occupant: "Dave", startTime: time.Now().Add(-3 * time.Hour), duration: 30 * time.Minute},  // overdue
 		},
 	}
 }
@@ -47,34 +58,37 @@ func getGarageState() interface{} {
 // run
 
 func (t TicketingChoreography) Run(op ChoreoOp) interface{} {
-	garageAtTicketer := op.Locally(Ticketer{}, func() interface{} {
-		return getGarageState()
+	spacesAtTicketer := op.Locally(Ticketer{}, func() interface{} {
+		return getGarageState().(Garage).spaces
 	})
 
 	// this is the key!! everyone needs to know about the garage
 	// since we need to know how many spots we will need to try and make decisions for,
-	// send decisions for, and receive decisions for.
-	garage := op.Broadcast(Ticketer{}, garageAtTicketer).(Garage)
-
-	for _, space := range garage.spaces {
+	// send decisions for, and receive decisions for. Loop broadcasts the spaces and keeps
+	// every location on the same space.
+	tickets := op.Loop(Ticketer{}, spacesAtTicketer, func(op ChoreoOp, item interface{}) (interface{}, Located) {
+		space := item.(ParkingSpace)
 		// Check if the space is occupied and if the duration has expired
 		decisionAtPA := op.Locally(
 			ParkingAuthority{}, func() interface{} {
 				decisionAtPA := space.occupied && space.startTime.Add(space.duration).Before(time.Now())
 				return decisionAtPA
 			})
-		decision := op.Broadcast(ParkingAuthority{}, decisionAtPA).(bool)
-		fmt.Printf("Space %d decision: %v\n", space.number, decision)
-
-		if decision {
+		// only the printer acts on the decision, so the ticketer doesn't need to hear about it
+		ticket := op.Cond(ParkingAuthority{}, []Location{Printer{}}, decisionAtPA, func(op ChoreoOp, choice interface{}) interface{} {
+			decision := choice.(bool)
+			fmt.Printf("Space %d decision: %v\n", space.number, decision)
+			if !decision {
+				return nil
+			}
 			// the space is expired, so send it to the printer
-			spaceAtTicketer := op.Comm(ParkingAuthority{}, Printer{}, Located{Value: space, Location: ParkingAuthority{}})
+			spaceAtPrinter := op.Comm(ParkingAuthority{}, Printer{}, Located{Value: space, Location: ParkingAuthority{}})
 			return op.Locally(Printer{}, func() interface{} {
 				printer := Printer{}
-				if spaceAtTicketer.Location != printer {
-					fmt.Printf("wrong location! Got %v\n", spaceAtTicketer.Location)
+				if spaceAtPrinter.Location != printer {
+					fmt.Printf("wrong location! Got %v\n", spaceAtPrinter.Location)
 				}
-				space, ok := spaceAtTicketer.Value.(ParkingSpace)
+				space, ok := spaceAtPrinter.Value.(ParkingSpace)
 				if !ok {
 					fmt.Printf("failed to cast to ParkingSpace\n")
 					return nil
@@ -82,9 +96,19 @@ func (t TicketingChoreography) Run(op ChoreoOp) interface{} {
 				fmt.Printf("Printing ticket for space %d occupied by %s\n", space.number, space.occupant)
 				return space
 			})
+		})
+		return ticket, Located{}
+	})
+
+	return op.Locally(Printer{}, func() interface{} {
+		ticketed := []ParkingSpace{}
+		for _, ticket := range tickets {
+			if ticket, ok := ticket.(Located); ok && ticket.Value != nil {
+				ticketed = append(ticketed, ticket.Value.(ParkingSpace))
+			}
 		}
-	}
-	return nil
+		return ticketed
+	})
 }
 
 // creates transports, projectors, and runs each endpoint
@@ -93,7 +117,7 @@ func RunParkingProtocol(transport Transport) chan ParkingSpace {
 	var wg sync.WaitGroup
 	wg.Add(3)
 
-	toTicket := make(chan ParkingSpace, 1)
+	var ticketed []ParkingSpace
 
 	// Ticketer endpoint
 	go func() {
@@ -115,13 +139,17 @@ func RunParkingProtocol(transport Transport) chan ParkingSpace {
 	go func() {
 		defer wg.Done()
 		printerProjector := NewProjector(Printer{}, transport)
-		space := printerProjector.EppAndRun(
+		spaces := printerProjector.EppAndRun(
 			TicketingChoreography{},
 		)
-		// Send the space to the result channel
-		toTicket <- space.(Located).Value.(ParkingSpace)
+		ticketed = spaces.(Located).Value.([]ParkingSpace)
 	}()
 
 	wg.Wait()
+	// Send the spaces to the result channel
+	toTicket := make(chan ParkingSpace, len(ticketed))
+	for _, space := range ticketed {
+		toTicket <- space
+	}
 	return toTicket
 }
@@ -13,17 +13,26 @@ func TestParkingChoreography(t *testing.T) {
 	fmt.Println("\n----------------------------------------")
 	fmt.Println("Running Parking Protocol with Local Channel Transport")
 	ticketChan := RunParkingProtocol(transport)
+	close(ticketChan)
 
-	// Wait for the ticket channel to receive a parking space
-	select {
-	case space := <-ticketChan:
+	var ticketed []ParkingSpace
+	for space := range ticketChan {
 		fmt.Printf("Received ticket for space %d\n", space.number)
-		if space.number != 3 {
-			t.Errorf("Expected ticket for space 3 but got %d", space.number)
+		ticketed = append(ticketed, space)
+	}
+	// every overdue space is ticketed, in garage order, and nothing else
+	want := []ParkingSpace{
+		{number: 3, occupied: true, occupant: "Bob", duration: time.Hour},
+		{number: 5, occupied: true, occupant: "Dave", duration: 30 * time.Minute},
+	}
+	if len(ticketed) != len(want) {
+		t.Fatalf("Expected tickets for %v but got %v", want, ticketed)
+	}
+	for i, space := range ticketed {
+		// start times come from the clock
+		space.startTime = time.Time{}
+		if space != want[i] {
+			t.Errorf("Expected ticket %d for %+v but got %+v", i, want[i], ticketed[i])
 		}
-		close(ticketChan)
-	case <-time.After(5 * time.Second):
-		close(ticketChan)
-		t.Error("Expected ticket but got none")
 	}
 }
@@ -0,0 +1,81 @@
+package capoeira
+
+import (
+	"context"
+	"sync"
+)
+
+// Unbounded is the queue capacity for queues that never make a sender wait.
+const Unbounded = -1
+
+// mailbox queues the messages from one location to another, making senders wait
+// while it holds capacity messages.
+type mailbox struct {
+	lock     sync.Mutex
+	queue    []message
+	capacity int
+	// arrived and taken are closed and replaced whenever a message is queued or taken,
+	// to wake whoever waits for one
+	arrived chan struct{}
+	taken   chan struct{}
+}
+
+func newMailbox(capacity int) *mailbox {
+	return &mailbox{capacity: capacity, arrived: make(chan struct{}), taken: make(chan struct{})}
+}
+
+// put queues msg, waiting for room until ctx is done. It returns the queue's depth
+// after msg was queued and whether it had to wait.
+func (m *mailbox) put(ctx context.Context, msg message) (depth int, blocked bool, err error) {
+	for {
+		m.lock.Lock()
+		if m.capacity == Unbounded || len(m.queue) < max(m.capacity, 1) {
+			m.queue = append(m.queue, msg)
+			close(m.arrived)
+			m.arrived = make(chan struct{})
+			depth = len(m.queue)
+			m.lock.Unlock()
+			return depth, blocked, nil
+		}
+		taken := m.taken
+		m.lock.Unlock()
+		blocked = true
+		select {
+		case <-taken:
+		case <-ctx.Done():
+			return 0, blocked, ctx.Err()
+		}
+	}
+}
+
+// len returns how many messages are queued.
+func (m *mailbox) len() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.queue)
+}
+
+// take waits until ctx is done for the next message, and returns it along with the
+// queue's depth after it was taken.
+func (m *mailbox) take(ctx context.Context) (msg message, depth int, err error) {
+	for {
+		m.lock.Lock()
+		if len(m.queue) > 0 {
+			msg = m.queue[0]
+			m.queue[0] = message{}
+			m.queue = m.queue[1:]
+			close(m.taken)
+			m.taken = make(chan struct{})
+			depth = len(m.queue)
+			m.lock.Unlock()
+			return msg, depth, nil
+		}
+		arrived := m.arrived
+		m.lock.Unlock()
+		select {
+		case <-arrived:
+		case <-ctx.Done():
+			return message{}, 0, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package capoeira
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestUnboundedQueueNeverBlocksSender(t *testing.T) {
+	transport := NewChannelTransport([]string{Seller{}.Name(), Buyer{}.Name()}, WithCapacity(Unbounded))
+	for i := range 100 {
+		transport.Send(Seller{}.Name(), Buyer{}.Name(), i)
+	}
+	for i := range 100 {
+		if got := transport.Receive(Seller{}.Name(), Buyer{}.Name()); got != i {
+			t.Fatalf("expected %d, got %v", i, got)
+		}
+	}
+}
+
+func TestFullQueueBlocksSender(t *testing.T) {
+	transport := NewChannelTransport([]string{Seller{}.Name(), Buyer{}.Name()}, WithCapacity(2))
+	transport.Metrics = NewMetrics()
+	for i := range 2 {
+		transport.Send(Seller{}.Name(), Buyer{}.Name(), i)
+	}
+	if depth := testutil.ToFloat64(transport.Metrics.queueDepth.WithLabelValues(Seller{}.Name(), Buyer{}.Name())); depth != 2 {
+		t.Errorf("expected a queue depth of 2, got %v", depth)
+	}
+	// a sender that can't wait gives up on the full queue, and gets in once there's room
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := transport.SendContext(ctx, Seller{}.Name(), Buyer{}.Name(), 2); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the third send to wait for the receiver, got %v", err)
+	}
+	transport.Receive(Seller{}.Name(), Buyer{}.Name())
+	if err := transport.SendContext(ctx, Seller{}.Name(), Buyer{}.Name(), 2); err != nil {
+		t.Errorf("expected room for the third send, got %v", err)
+	}
+	if n := testutil.ToFloat64(transport.Metrics.blockedSends.WithLabelValues(Seller{}.Name(), Buyer{}.Name())); n != 1 {
+		t.Errorf("expected 1 blocked send, got %v", n)
+	}
+}
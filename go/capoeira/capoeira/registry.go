@@ -0,0 +1,179 @@
+package capoeira
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Registry records where the endpoint of each location listens, so endpoints can
+// find each other without being configured with every address.
+type Registry interface {
+	Register(location, address string) error
+	Deregister(location string) error
+	// Resolve returns the address of a location's endpoint.
+	Resolve(location string) (string, error)
+}
+
+// ErrNotRegistered is returned by Resolve for a location nobody registered.
+var ErrNotRegistered = errors.New("capoeira: location not registered")
+
+// FileRegistry is a Registry kept as one file per location in a directory, shared by
+// the endpoints on one host or on a shared volume.
+type FileRegistry struct {
+	dir string
+}
+
+type registration struct {
+	Location string `json:"location"`
+	Address  string `json:"address"`
+}
+
+// NewFileRegistry uses dir as a registry, creating it if needed.
+func NewFileRegistry(dir string) (*FileRegistry, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating registry: %w", err)
+	}
+	return &FileRegistry{dir: dir}, nil
+}
+
+func (r *FileRegistry) path(location string) string {
+	return filepath.Join(r.dir, url.PathEscape(location)+".json")
+}
+
+// Register records the address of a location, replacing the file in one step so
+// readers never see it half written.
+func (r *FileRegistry) Register(location, address string) error {
+	b, err := json.Marshal(registration{Location: location, Address: address})
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(r.dir, ".register-*")
+	if err != nil {
+		return fmt.Errorf("registering %s: %w", location, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("registering %s: %w", location, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("registering %s: %w", location, err)
+	}
+	if err := os.Rename(tmp.Name(), r.path(location)); err != nil {
+		return fmt.Errorf("registering %s: %w", location, err)
+	}
+	return nil
+}
+
+func (r *FileRegistry) Deregister(location string) error {
+	if err := os.Remove(r.path(location)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("deregistering %s: %w", location, err)
+	}
+	return nil
+}
+
+func (r *FileRegistry) Resolve(location string) (string, error) {
+	b, err := os.ReadFile(r.path(location))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("%w: %s", ErrNotRegistered, location)
+	}
+	if err != nil {
+		return "", fmt.Errorf("resolving %s: %w", location, err)
+	}
+	var reg registration
+	if err := json.Unmarshal(b, &reg); err != nil {
+		return "", fmt.Errorf("resolving %s: %w", location, err)
+	}
+	return reg.Address, nil
+}
+
+// List returns the address of every registered location.
+func (r *FileRegistry) List() (map[string]string, error) {
+	entries, err := os.ReadDir(r.dir)
+	if err != nil {
+		return nil, fmt.Errorf("listing registry: %w", err)
+	}
+	addresses := make(map[string]string)
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(r.dir, entry.Name()))
+		if err != nil {
+			continue // deregistered while listing
+		}
+		var reg registration
+		if json.Unmarshal(b, &reg) == nil {
+			addresses[reg.Location] = reg.Address
+		}
+	}
+	return addresses, nil
+}
+
+// Watch polls the registry every interval until ctx is done, calling changed with
+// the addresses of every registered location whenever they differ from the last poll.
+func (r *FileRegistry) Watch(ctx context.Context, interval time.Duration, changed func(map[string]string)) {
+	var last map[string]string
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if addresses, err := r.List(); err == nil && (last == nil || !maps.Equal(addresses, last)) {
+			changed(addresses)
+			last = addresses
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// addressBook caches the addresses of locations, filled in by watching a registry.
+type addressBook struct {
+	lock      sync.Mutex
+	addresses map[string]string
+}
+
+func (b *addressBook) get(location string) (string, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	address, ok := b.addresses[location]
+	return address, ok
+}
+
+func (b *addressBook) set(location, address string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.addresses == nil {
+		b.addresses = make(map[string]string)
+	}
+	b.addresses[location] = address
+}
+
+// replace swaps in a new set of addresses, returning the locations added and removed.
+func (b *addressBook) replace(addresses map[string]string) (added, removed []string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for location := range addresses {
+		if _, ok := b.addresses[location]; !ok {
+			added = append(added, location)
+		}
+	}
+	for location := range b.addresses {
+		if _, ok := addresses[location]; !ok {
+			removed = append(removed, location)
+		}
+	}
+	b.addresses = maps.Clone(addresses)
+	return added, removed
+}
@@ -0,0 +1,57 @@
+package capoeira
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestEndpointsFindEachOtherThroughRegistry(t *testing.T) {
+	registry, err := NewFileRegistry(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	locations := []string{Seller{}.Name(), Buyer{}.Name()}
+	sellerSide := NewHTTPTransport(locations, WithPort(0), WithRegistry(registry, Seller{}.Name()))
+	defer sellerSide.StopServer()
+	buyerSide := NewHTTPTransport(locations, WithPort(0), WithRegistry(registry, Buyer{}.Name()))
+	defer buyerSide.StopServer()
+
+	if address, err := registry.Resolve(Seller{}.Name()); err != nil || address != sellerSide.Addr() {
+		t.Fatalf("expected the seller at %s, got %q (%v)", sellerSide.Addr(), address, err)
+	}
+	done := make(chan interface{})
+	go func() {
+		seller := NewProjector(Seller{}, sellerSide)
+		done <- seller.EppAndRun(BooksellerChoreography{Title: seller.Remote(Buyer{}), Budget: seller.Remote(Buyer{})})
+	}()
+	buyer := NewProjector(Buyer{}, buyerSide)
+	decision := buyer.EppAndRun(BooksellerChoreography{Title: buyer.Local("TAPL"), Budget: buyer.Local(BUDGET)})
+	if sold := <-done; decision != true || sold != true {
+		t.Errorf("expected both sides to decide to buy, got %v and %v", decision, sold)
+	}
+}
+
+func TestRegistryWatchSeesNewLocations(t *testing.T) {
+	registry, err := NewFileRegistry(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry.Register(Seller{}.Name(), "localhost:1")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan map[string]string)
+	go registry.Watch(ctx, time.Millisecond, func(addresses map[string]string) {
+		select {
+		case changes <- addresses:
+		case <-ctx.Done():
+		}
+	})
+	if addresses := <-changes; addresses[Seller{}.Name()] != "localhost:1" {
+		t.Fatalf("expected the seller's registration first, got %v", addresses)
+	}
+	registry.Register(Printer{}.Name(), "localhost:2")
+	if addresses := <-changes; addresses[Printer{}.Name()] != "localhost:2" {
+		t.Errorf("expected the printer's registration to be seen, got %v", addresses)
+	}
+}
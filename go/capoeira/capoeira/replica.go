@@ -0,0 +1,381 @@
+package capoeira
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+)
+
+// ReplicaGroup declares a location run by several replicas, each an endpoint of its
+// own in the wrapped transport. Every replica runs the location's projection, but
+// only the leader's messages reach other locations.
+type ReplicaGroup struct {
+	// Location is the name of the replicated location, as other locations know it.
+	Location string
+	// Replicas are the names of the replicas in the wrapped transport, in order of
+	// succession: the first live one leads.
+	Replicas []string
+}
+
+// ReplicatedTransport runs replica groups over another transport. Every live replica
+// receives the group's messages, and only the leader's are sent. A group's replicas
+// run in one process, each over the transport from ForReplica.
+type ReplicatedTransport struct {
+	inner  Transport
+	groups map[string]*replicas
+	// byReplica keys are replica names
+	byReplica map[string]*replicas
+	// Logger reports failovers and failures; nil uses DefaultLogger.
+	Logger *slog.Logger
+}
+
+// replicas tracks the state of one replica group.
+type replicas struct {
+	ReplicaGroup
+	lock   sync.Mutex
+	leader string
+	down   map[string]context.CancelFunc
+	// alive is done once a replica is marked down, to give up on messages to it.
+	alive map[string]context.Context
+	// sent counts the messages the group has sent to each location, and produced those
+	// each replica has tried to send.
+	sent     map[string]int
+	produced map[string]map[string]int
+	// held are the messages each follower hasn't sent, by destination.
+	held map[string]map[string][]heldMessage
+	// last is closed once the latest message to each location is delivered, so the
+	// next waits for it and messages are delivered in the order they were let through.
+	last map[string]chan struct{}
+}
+
+// heldMessage is a message from a follower, to send should it become the leader.
+type heldMessage struct {
+	ctx   context.Context
+	index int
+	data  interface{}
+}
+
+// NewReplicatedTransport runs the groups over inner, whose locations are the replicas
+// of each group and the locations that aren't replicated.
+func NewReplicatedTransport(inner Transport, groups ...ReplicaGroup) *ReplicatedTransport {
+	t := &ReplicatedTransport{inner: inner, groups: make(map[string]*replicas), byReplica: make(map[string]*replicas)}
+	for _, g := range groups {
+		r := &replicas{
+			ReplicaGroup: g,
+			down:         make(map[string]context.CancelFunc),
+			alive:        make(map[string]context.Context),
+			sent:         make(map[string]int),
+			produced:     make(map[string]map[string]int),
+			held:         make(map[string]map[string][]heldMessage),
+			last:         make(map[string]chan struct{}),
+		}
+		for _, name := range g.Replicas {
+			r.alive[name], r.down[name] = context.WithCancel(context.Background())
+			r.produced[name] = make(map[string]int)
+			r.held[name] = make(map[string][]heldMessage)
+			t.byReplica[name] = r
+		}
+		if len(g.Replicas) > 0 {
+			r.leader = g.Replicas[0]
+		}
+		t.groups[g.Location] = r
+	}
+	return t
+}
+
+// ForReplica returns the transport the named replica's projector runs over. The
+// projector's target is the replicated location.
+func (t *ReplicatedTransport) ForReplica(replica string) Transport {
+	r, ok := t.byReplica[replica]
+	if !ok {
+		panic(fmt.Sprintf("capoeira: %s is not a replica", replica))
+	}
+	return &replicaTransport{ReplicatedTransport: t, group: r, replica: replica}
+}
+
+func (t *ReplicatedTransport) logger() *slog.Logger {
+	if t.Logger != nil {
+		return t.Logger
+	}
+	return DefaultLogger()
+}
+
+// turn takes the next turn to deliver to a location, returning the previous turn's
+// channel to wait on and this one's to close. Called with the lock held.
+func (r *replicas) turn(to string) (prev, done chan struct{}) {
+	prev, done = r.last[to], make(chan struct{})
+	r.last[to] = done
+	return prev, done
+}
+
+// Leader returns the replica currently leading a group, or "" if none is live.
+func (t *ReplicatedTransport) Leader(location string) string {
+	r, ok := t.groups[location]
+	if !ok {
+		return ""
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.leader
+}
+
+// MarkDown takes a failed replica out of its group. If it led the group, the next
+// live replica takes over, and the messages the failed one didn't send are sent in
+// the background, ahead of the new leader's. A replica whose transport fails a send or
+// receive is marked down by it; call MarkDown for replicas that fail otherwise.
+func (t *ReplicatedTransport) MarkDown(replica string) {
+	r, ok := t.byReplica[replica]
+	if !ok {
+		return
+	}
+	type flush struct {
+		to         string
+		msgs       []heldMessage
+		prev, done chan struct{}
+	}
+	var flushes []flush
+	r.lock.Lock()
+	if r.alive[replica].Err() != nil {
+		r.lock.Unlock()
+		return
+	}
+	r.down[replica]()
+	if r.leader != replica {
+		r.lock.Unlock()
+		return
+	}
+	r.leader = ""
+	for _, name := range r.Replicas {
+		if r.alive[name].Err() == nil {
+			r.leader = name
+			break
+		}
+	}
+	leader := r.leader
+	if leader != "" {
+		for to, held := range r.held[leader] {
+			f := flush{to: to}
+			for _, msg := range held {
+				if msg.index == r.sent[to] {
+					f.msgs = append(f.msgs, msg)
+					r.sent[to]++
+				}
+			}
+			if len(f.msgs) > 0 {
+				f.prev, f.done = r.turn(to)
+				flushes = append(flushes, f)
+			}
+			delete(r.held[leader], to)
+		}
+	}
+	r.lock.Unlock()
+
+	if leader == "" {
+		t.logger().Error("no live replica left", "location", r.Location)
+		return
+	}
+	t.logger().Warn("replica took over", "location", r.Location, "replica", leader, "failed", replica)
+	for _, f := range flushes {
+		go func() {
+			defer close(f.done)
+			if f.prev != nil {
+				<-f.prev
+			}
+			for _, msg := range f.msgs {
+				if err := t.deliver(msg.ctx, r.Location, f.to, msg.data); err != nil {
+					t.logger().Error("send failed", "location", r.Location, "peer", f.to, "err", err)
+				}
+			}
+		}()
+	}
+}
+
+func (t *ReplicatedTransport) Send(from, to string, data interface{}) {
+	if err := t.SendContext(context.Background(), from, to, data); err != nil {
+		t.logger().Error("send failed", "location", from, "peer", to, "err", err)
+	}
+}
+
+// SendContext sends a message from a location that isn't replicated.
+func (t *ReplicatedTransport) SendContext(ctx context.Context, from, to string, data interface{}) error {
+	return t.deliver(ctx, from, to, data)
+}
+
+// deliver sends a message to a location, or to every live replica of a replicated one.
+func (t *ReplicatedTransport) deliver(ctx context.Context, from, to string, data interface{}) error {
+	r, ok := t.groups[to]
+	if !ok {
+		return t.send(ctx, from, to, data)
+	}
+	var errs []error
+	for _, replica := range r.Replicas {
+		alive := r.alive[replica]
+		if alive.Err() != nil {
+			continue
+		}
+		// a replica marked down while this waits for room in its queue is given up on
+		sctx, cancel := context.WithCancel(ctx)
+		stop := context.AfterFunc(alive, cancel)
+		err := t.send(sctx, from, replica, data)
+		stop()
+		cancel()
+		if err != nil && alive.Err() == nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+func (t *ReplicatedTransport) send(ctx context.Context, from, to string, data interface{}) error {
+	if inner, ok := t.inner.(ContextTransport); ok {
+		return inner.SendContext(ctx, from, to, data)
+	}
+	t.inner.Send(from, to, data)
+	return nil
+}
+
+func (t *ReplicatedTransport) Receive(from, at string) interface{} {
+	val, _, err := t.ReceiveContext(context.Background(), from, at)
+	if err != nil {
+		t.logger().Error("receive failed", "location", at, "peer", from, "err", err)
+	}
+	return val
+}
+
+// ReceiveContext receives at a location that isn't replicated.
+func (t *ReplicatedTransport) ReceiveContext(ctx context.Context, from, at string) (interface{}, context.Context, error) {
+	return t.receive(ctx, from, at)
+}
+
+func (t *ReplicatedTransport) receive(ctx context.Context, from, at string) (interface{}, context.Context, error) {
+	if inner, ok := t.inner.(ContextTransport); ok {
+		return inner.ReceiveContext(ctx, from, at)
+	}
+	return t.inner.Receive(from, at), ctx, nil
+}
+
+// Locations returns the locations of the inner transport, with the replicas of each
+// group standing in for it.
+func (t *ReplicatedTransport) Locations() []string {
+	var locations []string
+	for _, name := range t.inner.Locations() {
+		if r, ok := t.byReplica[name]; ok {
+			name = r.Location
+		}
+		if !slices.Contains(locations, name) {
+			locations = append(locations, name)
+		}
+	}
+	return locations
+}
+
+// Codec returns the codec of the inner transport.
+func (t *ReplicatedTransport) Codec() string {
+	return codecOf(t.inner)
+}
+
+// replicaTransport is the transport one replica of a group runs over.
+type replicaTransport struct {
+	*ReplicatedTransport
+	group   *replicas
+	replica string
+}
+
+func (t *replicaTransport) Send(from, to string, data interface{}) {
+	if err := t.SendContext(context.Background(), from, to, data); err != nil {
+		t.logger().Error("send failed", "location", from, "peer", to, "err", err)
+	}
+}
+
+// SendContext sends the replica's message if it leads its group, and holds it back
+// otherwise. If the leader's send fails, the next replica takes over and sends it.
+func (t *replicaTransport) SendContext(ctx context.Context, from, to string, data interface{}) error {
+	r := t.group
+	r.lock.Lock()
+	index := r.produced[t.replica][to]
+	r.produced[t.replica][to]++
+	if r.alive[t.replica].Err() != nil || index < r.sent[to] {
+		// down, or the leader already sent this one
+		r.lock.Unlock()
+		return nil
+	}
+	if r.leader != t.replica {
+		r.held[t.replica][to] = append(r.held[t.replica][to], heldMessage{ctx: context.WithoutCancel(ctx), index: index, data: data})
+		r.lock.Unlock()
+		return nil
+	}
+	r.sent[to] = index + 1
+	for _, follower := range r.Replicas {
+		held := r.held[follower][to]
+		for len(held) > 0 && held[0].index < r.sent[to] {
+			held = held[1:]
+		}
+		r.held[follower][to] = held
+	}
+	prev, done := r.turn(to)
+	r.lock.Unlock()
+
+	// deliver without the lock, so a failover isn't stuck behind a blocked send
+	defer close(done)
+	if prev != nil {
+		select {
+		case <-prev:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	err := t.deliver(ctx, r.Location, to, data)
+	if err != nil && ctx.Err() == nil {
+		t.failSend(to, heldMessage{ctx: context.WithoutCancel(ctx), index: index, data: data})
+		t.logger().Error("replica failed", "location", r.Location, "replica", t.replica, "peer", to, "err", err)
+		t.MarkDown(t.replica)
+	}
+	return err
+}
+
+// failSend hands a message the leader failed to send back to the live followers, to
+// send once one of them takes over.
+func (t *replicaTransport) failSend(to string, msg heldMessage) {
+	r := t.group
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.leader != t.replica || r.sent[to] != msg.index+1 {
+		return
+	}
+	r.sent[to] = msg.index
+	for _, follower := range r.Replicas {
+		if follower != t.replica && r.alive[follower].Err() == nil {
+			r.held[follower][to] = append([]heldMessage{msg}, r.held[follower][to]...)
+		}
+	}
+}
+
+func (t *replicaTransport) Receive(from, at string) interface{} {
+	val, _, err := t.ReceiveContext(context.Background(), from, at)
+	if err != nil {
+		t.logger().Error("receive failed", "location", t.replica, "peer", from, "err", err)
+	}
+	return val
+}
+
+// ReceiveContext receives the group's messages at the replica, giving up once it's marked down.
+func (t *replicaTransport) ReceiveContext(ctx context.Context, from, at string) (interface{}, context.Context, error) {
+	if at != t.group.Location {
+		return t.receive(ctx, from, at)
+	}
+	rctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(t.group.alive[t.replica], cancel)
+	defer stop()
+	val, remote, err := t.receive(rctx, from, t.replica)
+	if err != nil && rctx.Err() == nil {
+		t.logger().Error("replica failed", "location", at, "replica", t.replica, "peer", from, "err", err)
+		t.MarkDown(t.replica)
+	}
+	return val, remote, err
+}
@@ -0,0 +1,194 @@
+package capoeira
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// replicaChoreography passes numbers from the ticketer through the parking authority
+// to the printer. A replica given stall hangs on the number stallAt, as if it crashed.
+type replicaChoreography struct {
+	stall   chan struct{}
+	stalled chan struct{}
+	stallAt int
+}
+
+func (c replicaChoreography) Run(op ChoreoOp) interface{} {
+	var printed []interface{}
+	for i := range 3 {
+		n := op.Comm(Ticketer{}, ParkingAuthority{}, op.Locally(Ticketer{}, func() interface{} { return i }))
+		price := op.Locally(ParkingAuthority{}, func() interface{} {
+			if c.stall != nil && n.Value == c.stallAt {
+				close(c.stalled)
+				<-c.stall
+			}
+			return n.Value.(int) * 10
+		})
+		atPrinter := op.Comm(ParkingAuthority{}, Printer{}, price)
+		op.Locally(Printer{}, func() interface{} {
+			printed = append(printed, atPrinter.Value)
+			return nil
+		})
+	}
+	return printed
+}
+
+func TestReplicaFailover(t *testing.T) {
+	inner := NewChannelTransport([]string{Ticketer{}.Name(), "ParkingAuthority#1", "ParkingAuthority#2", Printer{}.Name()})
+	transport := NewReplicatedTransport(inner, ReplicaGroup{
+		Location: ParkingAuthority{}.Name(),
+		Replicas: []string{"ParkingAuthority#1", "ParkingAuthority#2"},
+	})
+	leader := replicaChoreography{stall: make(chan struct{}), stalled: make(chan struct{}), stallAt: 1}
+
+	var wg sync.WaitGroup
+	results := make(map[string]interface{})
+	errs := make(map[string]error)
+	var lock sync.Mutex
+	run := func(name string, p *Projector, choreo Choreography) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := p.EppAndRunContext(context.Background(), choreo)
+			lock.Lock()
+			results[name], errs[name] = res, err
+			lock.Unlock()
+		}()
+	}
+	run("ParkingAuthority#1", NewProjector(ParkingAuthority{}, transport.ForReplica("ParkingAuthority#1")), leader)
+	run("ParkingAuthority#2", NewProjector(ParkingAuthority{}, transport.ForReplica("ParkingAuthority#2")), replicaChoreography{})
+	run(Ticketer{}.Name(), NewProjector(Ticketer{}, transport), replicaChoreography{})
+	run(Printer{}.Name(), NewProjector(Printer{}, transport), replicaChoreography{})
+
+	<-leader.stalled
+	transport.MarkDown("ParkingAuthority#1")
+	close(leader.stall)
+	if got := transport.Leader(ParkingAuthority{}.Name()); got != "ParkingAuthority#2" {
+		t.Errorf("expected ParkingAuthority#2 to take over, got %q", got)
+	}
+	wg.Wait()
+
+	printed, _ := results[Printer{}.Name()].([]interface{})
+	if len(printed) != 3 || printed[0] != 0 || printed[1] != 10 || printed[2] != 20 {
+		t.Errorf("expected [0 10 20] at the printer, got %v", results[Printer{}.Name()])
+	}
+	for _, name := range []string{Ticketer{}.Name(), Printer{}.Name(), "ParkingAuthority#2"} {
+		if errs[name] != nil {
+			t.Errorf("expected %s to finish, got %v", name, errs[name])
+		}
+	}
+}
+
+func TestReplicaMarkDownDuringBlockedSend(t *testing.T) {
+	inner := NewChannelTransport([]string{"ParkingAuthority#1", "ParkingAuthority#2", Printer{}.Name()})
+	transport := NewReplicatedTransport(inner, ReplicaGroup{
+		Location: ParkingAuthority{}.Name(),
+		Replicas: []string{"ParkingAuthority#1", "ParkingAuthority#2"},
+	})
+	leader := transport.ForReplica("ParkingAuthority#1").(ContextTransport)
+	follower := transport.ForReplica("ParkingAuthority#2").(ContextTransport)
+	ctx := context.Background()
+	from, to := ParkingAuthority{}.Name(), Printer{}.Name()
+	for i := range 2 {
+		if err := follower.SendContext(ctx, from, to, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := leader.SendContext(ctx, from, to, 0); err != nil {
+		t.Fatal(err)
+	}
+	// the printer's queue is full, so this send waits for the printer
+	sent := make(chan error)
+	go func() { sent <- leader.SendContext(ctx, from, to, 1) }()
+
+	transport.MarkDown("ParkingAuthority#1")
+	if got := transport.Leader(from); got != "ParkingAuthority#2" {
+		t.Errorf("expected ParkingAuthority#2 to take over, got %q", got)
+	}
+	for i := range 2 {
+		val, _, err := transport.ReceiveContext(ctx, from, to)
+		if err != nil || val != i {
+			t.Errorf("expected %d at the printer, got %v, %v", i, val, err)
+		}
+	}
+	if err := <-sent; err != nil {
+		t.Errorf("expected the leader's send to finish, got %v", err)
+	}
+}
+
+// flakyTransport fails the next send once fail is set.
+type flakyTransport struct {
+	*ChannelTransport
+	fail atomic.Bool
+}
+
+func (t *flakyTransport) SendContext(ctx context.Context, from, to string, data interface{}) error {
+	if t.fail.Swap(false) {
+		return errors.New("connection reset")
+	}
+	return t.ChannelTransport.SendContext(ctx, from, to, data)
+}
+
+func TestReplicaFailsOverOnSendError(t *testing.T) {
+	inner := &flakyTransport{ChannelTransport: NewChannelTransport([]string{"ParkingAuthority#1", "ParkingAuthority#2", Printer{}.Name()}, WithCapacity(Unbounded))}
+	transport := NewReplicatedTransport(inner, ReplicaGroup{
+		Location: ParkingAuthority{}.Name(),
+		Replicas: []string{"ParkingAuthority#1", "ParkingAuthority#2"},
+	})
+	leader := transport.ForReplica("ParkingAuthority#1").(ContextTransport)
+	follower := transport.ForReplica("ParkingAuthority#2").(ContextTransport)
+	ctx := context.Background()
+	from, to := ParkingAuthority{}.Name(), Printer{}.Name()
+
+	inner.fail.Store(true)
+	if err := leader.SendContext(ctx, from, to, 0); err == nil {
+		t.Fatalf("expected the leader's send to fail")
+	}
+	if got := transport.Leader(from); got != "ParkingAuthority#2" {
+		t.Errorf("expected ParkingAuthority#2 to take over, got %q", got)
+	}
+	// the new leader sends the message the old one couldn't, and carries on
+	for i := range 2 {
+		if err := follower.SendContext(ctx, from, to, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range 2 {
+		val, _, err := transport.ReceiveContext(ctx, from, to)
+		if err != nil || val != i {
+			t.Errorf("expected %d at the printer, got %v, %v", i, val, err)
+		}
+	}
+}
+
+func TestReplicaFailsOverWithHeldMessages(t *testing.T) {
+	inner := &flakyTransport{ChannelTransport: NewChannelTransport([]string{"ParkingAuthority#1", "ParkingAuthority#2", Printer{}.Name()}, WithCapacity(Unbounded))}
+	transport := NewReplicatedTransport(inner, ReplicaGroup{
+		Location: ParkingAuthority{}.Name(),
+		Replicas: []string{"ParkingAuthority#1", "ParkingAuthority#2"},
+	})
+	leader := transport.ForReplica("ParkingAuthority#1").(ContextTransport)
+	follower := transport.ForReplica("ParkingAuthority#2").(ContextTransport)
+	ctx := context.Background()
+	from, to := ParkingAuthority{}.Name(), Printer{}.Name()
+
+	// the follower is ahead, so the message the leader fails to send is flushed from it
+	for i := range 2 {
+		if err := follower.SendContext(ctx, from, to, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inner.fail.Store(true)
+	if err := leader.SendContext(ctx, from, to, 0); err == nil {
+		t.Fatalf("expected the leader's send to fail")
+	}
+	for i := range 2 {
+		val, _, err := transport.ReceiveContext(ctx, from, to)
+		if err != nil || val != i {
+			t.Errorf("expected %d at the printer, got %v, %v", i, val, err)
+		}
+	}
+}
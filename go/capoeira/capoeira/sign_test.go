@@ -0,0 +1,54 @@
+package capoeira
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSignRejectsForgedSender(t *testing.T) {
+	dir := t.TempDir()
+	topology := Topology{Locations: map[string]LocationConfig{}}
+	for _, name := range []string{Seller{}.Name(), Buyer{}.Name()} {
+		verifyKey, signingKey, err := GenerateSigningKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name+".key"), []byte(signingKey), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		topology.Locations[name] = LocationConfig{VerifyKey: verifyKey, SigningKeyFile: name + ".key"}
+	}
+	b, _ := json.Marshal(topology)
+	path := filepath.Join(dir, "topology.json")
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadTopology(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign, err := SignFromTopology(loaded, []string{Seller{}.Name(), Buyer{}.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner := jsonTransport{NewChannelTransport([]string{Seller{}.Name(), Buyer{}.Name()})}
+	transport := Chain(inner, sign)
+
+	// the buyer claims to be the seller, signing with its own key
+	buyerKeys, _ := loaded.SigningKeys(Buyer{}.Name())
+	forged := &Envelope{From: Seller{}.Name(), To: Buyer{}.Name(), Header: map[string]string{}, Payload: 1}
+	payload, _ := forged.Encode()
+	forged.Header[SignatureHeader] = base64.StdEncoding.EncodeToString(ed25519.Sign(buyerKeys[Buyer{}.Name()], signed(forged, payload)))
+
+	go func() {
+		inner.Send(Seller{}.Name(), Buyer{}.Name(), forged)
+		transport.Send(Seller{}.Name(), Buyer{}.Name(), 2)
+	}()
+	if got := transport.Receive(Seller{}.Name(), Buyer{}.Name()); got != 2.0 {
+		t.Errorf("expected the signed message 2, got %v", got)
+	}
+}
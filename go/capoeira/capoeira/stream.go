@@ -0,0 +1,223 @@
+package capoeira
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// streamChunk is the most data a frame of a stream carries.
+	streamChunk = 32 << 10
+	// streamWindow is how many frames a sender may have in flight before the receiver
+	// gives it credit for more.
+	streamWindow = 8
+)
+
+// streamFrame is one message of a stream. Senders send chunks and then an end, and
+// receivers grant credit for each window of chunks taken and confirm the end with done.
+type streamFrame struct {
+	Chunk  []byte `json:"chunk,omitempty"`
+	End    bool   `json:"end,omitempty"`
+	Err    string `json:"err,omitempty"`
+	Credit int    `json:"credit,omitempty"`
+	Done   bool   `json:"done,omitempty"`
+}
+
+// toFrame recovers a frame from what the transport delivered, which is a generic
+// value if the transport encoded it on the way.
+func toFrame(data interface{}) (streamFrame, error) {
+	switch f := data.(type) {
+	case streamFrame:
+		return f, nil
+	case *streamFrame:
+		return *f, nil
+	case nil:
+		return streamFrame{}, fmt.Errorf("no stream frame received")
+	}
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return streamFrame{}, fmt.Errorf("re-encoding stream frame: %w", err)
+	}
+	var f streamFrame
+	if err := json.Unmarshal(raw, &f); err != nil {
+		return streamFrame{}, fmt.Errorf("decoding stream frame: %w", err)
+	}
+	return f, nil
+}
+
+// CommStream sends the io.Reader at sender to receiver in chunks, returning an
+// io.ReadCloser at receiver. Other operations between the two wait until the receiver
+// reads it to the end or closes it. A run with a Journal aborts at CommStream.
+func (op ProjectorChoreoOp) CommStream(sender, receiver Location, data Located) Located {
+	seq := op.next()
+	if op.journal != nil && (op.Target.Name() == sender.Name() || op.Target.Name() == receiver.Name()) {
+		panic(runAbort{fmt.Errorf("capoeira: CommStream from %s to %s in a journaled run", sender.Name(), receiver.Name())})
+	}
+	if sender.Name() == receiver.Name() {
+		if sender.Name() == op.Target.Name() {
+			return Located{Value: io.NopCloser(data.Get().(io.Reader)), Location: receiver}
+		}
+		return Located{Location: receiver}
+	}
+	switch op.Target.Name() {
+	case sender.Name():
+		ctx, span := op.span("CommStream", seq, receiver.Name())
+		defer span.End()
+		if op.pending != nil {
+			// credits come back on the same queue as async receives from the receiver
+			op.pending.wait(receiver.Name())
+		}
+		r, _ := data.Get().(io.Reader)
+		op.debug("streaming", "comm_stream", seq, receiver.Name())
+		if err := op.sendStream(ctx, receiver.Name(), r); err != nil {
+			op.fail(ctx, seq, receiver.Name(), err)
+		}
+		op.debug("streamed", "comm_stream", seq, receiver.Name())
+		return Located{Location: receiver}
+	case receiver.Name():
+		ctx, span := op.span("CommStream", seq, sender.Name())
+		pr, pw := io.Pipe()
+		done := newFuture()
+		waitPrev := func() {}
+		if op.pending != nil {
+			waitPrev = op.pending.pushStream(sender.Name(), done)
+		}
+		op.debug("receiving stream", "comm_stream", seq, sender.Name())
+		go func() {
+			defer span.End()
+			waitPrev()
+			err := op.receiveStream(ctx, sender.Name(), pw)
+			pw.CloseWithError(err)
+			op.debug("received stream", "comm_stream", seq, sender.Name(), "err", err)
+			done.resolve(nil)
+		}()
+		return Located{Value: pr, Location: receiver}
+	}
+	return Located{Location: receiver}
+}
+
+// sendStream sends r to a peer in frames, waiting for credit when the window is full
+// and then for the peer to confirm it took the whole stream. A failure reading r
+// ends the stream with the error, which the peer's reader returns.
+func (op ProjectorChoreoOp) sendStream(ctx context.Context, to string, r io.Reader) error {
+	if r == nil {
+		r = eofReader{}
+	}
+	credit := streamWindow
+	end := streamFrame{End: true}
+	for {
+		buf := make([]byte, streamChunk)
+		n, readErr := io.ReadFull(r, buf)
+		if n > 0 {
+			for credit == 0 {
+				f, err := op.collect(ctx, to)
+				if err != nil {
+					return err
+				}
+				credit += f.Credit
+			}
+			if err := op.transmit(ctx, to, streamFrame{Chunk: buf[:n]}); err != nil {
+				return err
+			}
+			credit--
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			if op.logger != nil {
+				op.logger.Error("reading stream failed", "peer", to, "err", readErr)
+			}
+			end.Err = readErr.Error()
+			break
+		}
+	}
+	if err := op.transmit(ctx, to, end); err != nil {
+		return err
+	}
+	// take the credits still coming before the receiver's confirmation
+	for {
+		f, err := op.collect(ctx, to)
+		if err != nil {
+			return err
+		}
+		if f.Done {
+			return nil
+		}
+	}
+}
+
+// receiveStream writes the chunks of a stream from a peer to w, or drops them once w
+// is closed, granting credit after each window and confirming the end.
+func (op ProjectorChoreoOp) receiveStream(ctx context.Context, from string, w io.Writer) error {
+	var writeErr error
+	for taken := 1; ; taken++ {
+		f, err := op.collect(ctx, from)
+		if err != nil {
+			return err
+		}
+		if f.End {
+			if err := op.transmit(ctx, from, streamFrame{Done: true}); err != nil {
+				return err
+			}
+			if f.Err != "" {
+				return errors.New(f.Err)
+			}
+			return writeErr
+		}
+		if writeErr == nil {
+			_, writeErr = w.Write(f.Chunk)
+		}
+		if taken%streamWindow != 0 {
+			continue
+		}
+		if err := op.transmit(ctx, from, streamFrame{Credit: streamWindow}); err != nil {
+			return err
+		}
+	}
+}
+
+// transmit sends a frame straight over the transport, outside any operation.
+func (op ProjectorChoreoOp) transmit(ctx context.Context, to string, f streamFrame) error {
+	ctx, cancel := op.withDeadline(ctx)
+	defer cancel()
+	if t, ok := op.Transport.(ContextTransport); ok {
+		return t.SendContext(ctx, op.Target.Name(), to, f)
+	}
+	op.Transport.Send(op.Target.Name(), to, f)
+	return nil
+}
+
+// collect receives a frame straight from the transport, outside any operation.
+func (op ProjectorChoreoOp) collect(ctx context.Context, from string) (streamFrame, error) {
+	ctx, cancel := op.withDeadline(ctx)
+	defer cancel()
+	t, ok := op.Transport.(ContextTransport)
+	if !ok {
+		return toFrame(op.Transport.Receive(from, op.Target.Name()))
+	}
+	for {
+		data, _, err := t.ReceiveContext(ctx, from, op.Target.Name())
+		if err != nil {
+			return streamFrame{}, err
+		}
+		// a peer may have sent an abort notice instead, for this session or another one
+		reason, session, ok := abortNotice(data)
+		if !ok {
+			return toFrame(data)
+		}
+		if session == SessionFromContext(op.context()) {
+			return streamFrame{}, &PeerAbortError{Location: op.Target.Name(), Peer: from, Reason: reason}
+		}
+	}
+}
+
+// eofReader is an empty stream, sent when the sender had no reader.
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
@@ -0,0 +1,61 @@
+package capoeira
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"path/filepath"
+	"testing"
+)
+
+type streamChoreography struct {
+	document []byte
+}
+
+func (c streamChoreography) Run(op ChoreoOp) interface{} {
+	document := op.Locally(Seller{}, func() interface{} { return bytes.NewReader(c.document) })
+	atBuyer := op.CommStream(Seller{}, Buyer{}, document)
+	sum := op.Locally(Buyer{}, func() interface{} {
+		b, err := io.ReadAll(atBuyer.Value.(io.Reader))
+		if err != nil {
+			return err.Error()
+		}
+		return fmt.Sprintf("%x", sha256.Sum256(b))
+	})
+	// the way back is free again once the stream is read
+	return op.Comm(Buyer{}, Seller{}, sum).Value
+}
+
+func TestCommStreamDeliversLargePayload(t *testing.T) {
+	document := make([]byte, 1<<20+123)
+	rand.Read(document)
+	want := fmt.Sprintf("%x", sha256.Sum256(document))
+
+	for name, transport := range map[string]Transport{
+		"channels": NewChannelTransport([]string{Seller{}.Name(), Buyer{}.Name()}),
+		"json":     jsonTransport{NewChannelTransport([]string{Seller{}.Name(), Buyer{}.Name()})},
+	} {
+		results := runAll(transport, streamChoreography{document: document}, Seller{}, Buyer{})
+		for loc, got := range results {
+			if got != want {
+				t.Errorf("%s: expected the document's hash at %s, got %v", name, loc, got)
+			}
+		}
+	}
+}
+
+func TestCommStreamRefusesJournal(t *testing.T) {
+	journal, err := OpenFileJournal(filepath.Join(t.TempDir(), "buyer.journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	p := NewProjector(Buyer{}, NewChannelTransport([]string{Seller{}.Name(), Buyer{}.Name()}))
+	p.Journal = journal
+	if _, err := p.EppAndRunContext(context.Background(), streamChoreography{}); err == nil {
+		t.Error("expected a journaled run to abort at CommStream")
+	}
+}
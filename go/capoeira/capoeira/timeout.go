@@ -0,0 +1,106 @@
+package capoeira
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// TimeoutError reports that a location gave up on an operation with a peer because
+// the operation's or the run's deadline passed.
+type TimeoutError struct {
+	Location string
+	Peer     string
+	// Seq is the sequence number of the operation within the run.
+	Seq uint64
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("capoeira: %s timed out on op %d with %s", e.Location, e.Seq, e.Peer)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+// PeerAbortError reports that a peer aborted the run, and told this location so
+// it doesn't wait for messages that won't come.
+type PeerAbortError struct {
+	Location string
+	Peer     string
+	Reason   string
+}
+
+func (e *PeerAbortError) Error() string {
+	return fmt.Sprintf("capoeira: %s aborted the run at %s: %s", e.Peer, e.Location, e.Reason)
+}
+
+// runAbort is panicked with to unwind a run that can't go on, and recovered by EppAndRunContext.
+type runAbort struct {
+	err error
+}
+
+// abortKey marks the message a location sends its peers when it aborts a run, and
+// abortSessionKey names the session of the run.
+const (
+	abortKey        = "capoeira.abort"
+	abortSessionKey = "capoeira.session"
+)
+
+// abortNotice returns the reason and session given by a peer's abort notice, if val is one.
+func abortNotice(val interface{}) (reason, session string, ok bool) {
+	m, ok := val.(map[string]interface{})
+	if !ok {
+		return "", "", false
+	}
+	reason, ok = m[abortKey].(string)
+	session, _ = m[abortSessionKey].(string)
+	return reason, session, ok
+}
+
+// withDeadline returns ctx limited by the op's timeout, if it has one.
+func (op ProjectorChoreoOp) withDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	if op.timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, op.timeout)
+}
+
+// fail aborts the run after an operation with peer failed with err, or was given up
+// on because ctx ended.
+func (op ProjectorChoreoOp) fail(ctx context.Context, seq uint64, peer string, err error) {
+	if ctx.Err() == context.DeadlineExceeded {
+		panic(runAbort{&TimeoutError{Location: op.Target.Name(), Peer: peer, Seq: seq}})
+	}
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if errors.Is(err, context.Canceled) {
+		panic(runAbort{fmt.Errorf("capoeira: %s cancelled on op %d with %s: %w", op.Target.Name(), seq, peer, err)})
+	}
+	panic(runAbort{fmt.Errorf("capoeira: %s failed on op %d with %s: %w", op.Target.Name(), seq, peer, err)})
+}
+
+// abortPeers tells the run's other locations, except the one that aborted the run, that
+// this location has given up on it. Notices are best effort, and given a second each;
+// a transport that can't give up on a send isn't sent any, so peers wait on their timeouts.
+func (op ProjectorChoreoOp) abortPeers(err error) {
+	t, ok := op.Transport.(ContextTransport)
+	if !ok {
+		return
+	}
+	except := op.Target.Name()
+	if pe, ok := err.(*PeerAbortError); ok {
+		except = pe.Peer
+	}
+	notice := map[string]interface{}{abortKey: err.Error(), abortSessionKey: SessionFromContext(op.context())}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(op.context()), time.Second)
+	defer cancel()
+	for _, peer := range op.locations() {
+		if peer == op.Target.Name() || peer == except {
+			continue
+		}
+		t.SendContext(ctx, op.Target.Name(), peer, notice)
+	}
+}
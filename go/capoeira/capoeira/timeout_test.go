@@ -0,0 +1,139 @@
+package capoeira
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type relayChoreography struct{}
+
+func (relayChoreography) Run(op ChoreoOp) interface{} {
+	ticket := op.Comm(ParkingAuthority{}, Printer{}, op.Locally(ParkingAuthority{}, func() interface{} { return "ticket" }))
+	return op.Comm(Printer{}, Ticketer{}, ticket).Value
+}
+
+func TestTimeoutAbortsPeers(t *testing.T) {
+	// the parking authority never runs
+	transport := NewChannelTransport([]string{Ticketer{}.Name(), ParkingAuthority{}.Name(), Printer{}.Name()})
+	errs := make(chan error)
+	go func() {
+		printer := NewProjector(Printer{}, transport)
+		printer.OpTimeout = 50 * time.Millisecond
+		_, err := printer.EppAndRunContext(context.Background(), relayChoreography{})
+		errs <- err
+	}()
+	go func() {
+		_, err := NewProjector(Ticketer{}, transport).EppAndRunContext(context.Background(), relayChoreography{})
+		errs <- err
+	}()
+
+	var timeout *TimeoutError
+	var abort *PeerAbortError
+	for range 2 {
+		switch err := <-errs; {
+		case errors.As(err, &timeout):
+			if timeout.Peer != (ParkingAuthority{}).Name() || !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("expected the printer to time out on the parking authority, got %v", err)
+			}
+		case errors.As(err, &abort):
+			if abort.Location != (Ticketer{}).Name() || abort.Peer != (Printer{}).Name() {
+				t.Errorf("expected the printer to abort the ticketer, got %v", err)
+			}
+		default:
+			t.Errorf("expected a timeout or an abort, got %v", err)
+		}
+	}
+	if timeout == nil || abort == nil {
+		t.Errorf("expected one timeout and one abort, got %v and %v", timeout, abort)
+	}
+}
+
+// failingTransport fails every send to one location.
+type failingTransport struct {
+	*ChannelTransport
+	to  string
+	err error
+}
+
+func (t failingTransport) SendContext(ctx context.Context, from, to string, data interface{}) error {
+	if to == t.to {
+		return t.err
+	}
+	return t.ChannelTransport.SendContext(ctx, from, to, data)
+}
+
+func TestTransportErrorAbortsRun(t *testing.T) {
+	errDown := errors.New("printer is down")
+	transport := failingTransport{
+		ChannelTransport: NewChannelTransport([]string{Ticketer{}.Name(), ParkingAuthority{}.Name(), Printer{}.Name()}),
+		to:               Printer{}.Name(),
+		err:              errDown,
+	}
+	_, err := NewProjector(ParkingAuthority{}, transport).EppAndRunContext(context.Background(), relayChoreography{})
+	if !errors.Is(err, errDown) {
+		t.Errorf("expected the run to fail with the transport's error, got %v", err)
+	}
+}
+
+func TestAbortLeavesOtherSessions(t *testing.T) {
+	aborted, served := Buyer{ID: "b-1"}, Buyer{ID: "b-2"}
+	transport := NewChannelTransport([]string{Seller{}.Name(), aborted.Name(), served.Name()}, WithCapacity(Unbounded))
+	run := func(ctx context.Context, loc Location, buyer Buyer) (interface{}, error) {
+		p := NewProjector(loc, transport)
+		p.Session = "books/" + buyer.ID
+		choreo := BooksellerChoreography{Title: p.Remote(buyer), Budget: p.Remote(buyer), Buyer: buyer}
+		if loc == buyer {
+			choreo.Title, choreo.Budget = p.Local("TAPL"), p.Local(BUDGET)
+		}
+		return p.EppAndRunContext(ctx, choreo)
+	}
+
+	// the seller gives up on b-1 before it asks, and a notice from another session
+	// on the same link is waiting for the seller of b-2
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := run(cancelled, Seller{}, aborted); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the seller of b-1 to be cancelled, got %v", err)
+	}
+	transport.Send(served.Name(), Seller{}.Name(), map[string]interface{}{abortKey: "gone", abortSessionKey: "books/b-0"})
+
+	errs := make(chan error, 2)
+	decisions := make(chan interface{}, 1)
+	go func() {
+		_, err := run(context.Background(), aborted, aborted)
+		errs <- err
+	}()
+	go func() {
+		_, err := run(context.Background(), Seller{}, served)
+		errs <- err
+	}()
+	go func() {
+		decision, err := run(context.Background(), served, served)
+		errs <- err
+		decisions <- decision
+	}()
+
+	var abort *PeerAbortError
+	var failed int
+	for range 3 {
+		err := <-errs
+		switch {
+		case err == nil:
+		case errors.As(err, &abort) && abort.Location == aborted.Name():
+			failed++
+		default:
+			t.Errorf("expected only b-1 to be aborted, got %v", err)
+		}
+	}
+	if failed != 1 {
+		t.Errorf("expected b-1 to be aborted by the seller, got %d aborts", failed)
+	}
+	if decision := <-decisions; decision != true {
+		t.Errorf("expected b-2 to buy the book, got %v", decision)
+	}
+	if n := transport.mailbox(Seller{}.Name(), served.Name()).len(); n != 0 {
+		t.Errorf("expected no abort notice for b-2, got %d messages left", n)
+	}
+}
@@ -0,0 +1,69 @@
+package capoeira
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// TLSConfig configures TLS for an HTTPTransport.
+type TLSConfig struct {
+	// Certificate is served by the transport's server.
+	Certificate tls.Certificate
+	// RootCAs verify the server's certificate when sending; nil uses the system roots.
+	RootCAs *x509.CertPool
+	// ClientCAs, if set, turn on mutual TLS: senders must present a certificate
+	// signed by one of them that identifies the location in the message's from
+	// field, by common name or DNS name.
+	ClientCAs *x509.CertPool
+	// ClientCertificates holds the certificate each location presents when sending.
+	ClientCertificates map[string]tls.Certificate
+}
+
+// WithTLS serves and posts messages over TLS, verifying senders if cfg has ClientCAs.
+func WithTLS(cfg TLSConfig) HTTPOption {
+	return func(t *HTTPTransport) {
+		t.tls = &cfg
+	}
+}
+
+func (c *TLSConfig) server() *tls.Config {
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{c.Certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.ClientCAs != nil {
+		cfg.ClientCAs = c.ClientCAs
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg
+}
+
+// client returns the TLS config a location sends with.
+func (c *TLSConfig) client(from string) *tls.Config {
+	cfg := &tls.Config{
+		RootCAs:    c.RootCAs,
+		MinVersion: tls.VersionTLS12,
+	}
+	if cert, ok := c.ClientCertificates[from]; ok {
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg
+}
+
+// verifyPeer checks that the client certificate of r identifies the location it claims to send from.
+func (t *HTTPTransport) verifyPeer(r *http.Request, from string) error {
+	if t.tls == nil || t.tls.ClientCAs == nil {
+		return nil
+	}
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return fmt.Errorf("no client certificate")
+	}
+	cert := r.TLS.PeerCertificates[0]
+	if cert.Subject.CommonName != from && !slices.Contains(cert.DNSNames, from) {
+		return fmt.Errorf("client certificate for %q can't send as %q", cert.Subject.CommonName, from)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package capoeira
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// issue creates a certificate for name signed by ca, or self-signed if ca is nil.
+func issue(t *testing.T, name string, ca *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.IPv6loopback, net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parent, signer := template, interface{}(key)
+	if ca == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+	} else {
+		parent, signer = ca.Leaf, ca.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestMutualTLSChecksSender(t *testing.T) {
+	ca := issue(t, "capoeira test CA", nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	buyerCert := issue(t, Buyer{}.Name(), &ca)
+	transport := NewHTTPTransport([]string{Seller{}.Name(), Buyer{}.Name()}, WithPort(0), WithTLS(TLSConfig{
+		Certificate: issue(t, "localhost", &ca),
+		RootCAs:     pool,
+		ClientCAs:   pool,
+		ClientCertificates: map[string]tls.Certificate{
+			Seller{}.Name(): issue(t, Seller{}.Name(), &ca),
+			Buyer{}.Name():  buyerCert,
+		},
+	}))
+	defer transport.StopServer()
+
+	RunBookSellerProtocol("TAPL", transport)
+
+	// the buyer's certificate can't be used to send as the seller
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      pool,
+		Certificates: []tls.Certificate{buyerCert},
+	}}}
+	body := []byte(`{"from": "Seller", "to": "Buyer", "data": 1000}`)
+	resp, err := client.Post(transport.url("/message"), "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected %d for a forged sender, got %d", http.StatusForbidden, resp.StatusCode)
+	}
+
+	// and nobody gets in without a certificate
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	if resp, err := anonymous.Post(transport.url("/message"), "application/json", bytes.NewReader(body)); err == nil {
+		resp.Body.Close()
+		t.Errorf("expected a sender without a certificate to be refused, got %s", resp.Status)
+	}
+}
@@ -0,0 +1,200 @@
+package capoeira
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Topology describes the locations of a deployment. It is loaded from a JSON file
+// shared by every endpoint, so it holds no secrets: private keys stay in files
+// next to the endpoints that use them.
+type Topology struct {
+	Locations map[string]LocationConfig `json:"locations"`
+	// dir resolves relative key files, and is the directory the topology was loaded from.
+	dir string
+}
+
+// LocationConfig describes one location of a Topology.
+type LocationConfig struct {
+	// VerifyKey is the base64 Ed25519 public key the location's messages are signed with.
+	VerifyKey string `json:"verify_key,omitempty"`
+	// SigningKeyFile is the path of a file holding the location's base64 Ed25519 private key.
+	SigningKeyFile string `json:"signing_key_file,omitempty"`
+	// EncryptionKey is the base64 X25519 public key payloads for the location are encrypted to.
+	EncryptionKey string `json:"encryption_key,omitempty"`
+	// DecryptionKeyFile is the path of a file holding the location's base64 X25519 private key.
+	DecryptionKeyFile string `json:"decryption_key_file,omitempty"`
+	// Compression lists the codecs the location accepts payloads compressed with, preferred first.
+	Compression []string `json:"compression,omitempty"`
+	// Replicas, if set, names the endpoints running the location, in order of succession.
+	Replicas []string `json:"replicas,omitempty"`
+}
+
+// LoadTopology reads a topology from a JSON file.
+func LoadTopology(path string) (*Topology, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading topology: %w", err)
+	}
+	t := &Topology{}
+	if err := json.Unmarshal(b, t); err != nil {
+		return nil, fmt.Errorf("parsing topology %s: %w", path, err)
+	}
+	t.dir = filepath.Dir(path)
+	return t, nil
+}
+
+// Names returns the names of the locations, sorted.
+func (t *Topology) Names() []string {
+	names := make([]string, 0, len(t.Locations))
+	for name := range t.Locations {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// ReplicaGroups returns the replicated locations, for a ReplicatedTransport.
+func (t *Topology) ReplicaGroups() []ReplicaGroup {
+	var groups []ReplicaGroup
+	for _, name := range t.Names() {
+		if replicas := t.Locations[name].Replicas; len(replicas) > 0 {
+			groups = append(groups, ReplicaGroup{Location: name, Replicas: replicas})
+		}
+	}
+	return groups
+}
+
+// Supports checks the topology has every location a choreography involves. A role
+// is there if the topology has it or one of its instances.
+func (t *Topology) Supports(info ChoreographyInfo) error {
+	var missing []string
+	for _, location := range info.Locations {
+		if !slices.ContainsFunc(t.Names(), func(name string) bool {
+			return name == location || strings.HasPrefix(name, location+"/")
+		}) {
+			missing = append(missing, location)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("topology has no %s for choreography %s", strings.Join(missing, ", "), info.Name)
+	}
+	return nil
+}
+
+// VerifyKeys returns the public keys of the locations that have one.
+func (t *Topology) VerifyKeys() (map[string]ed25519.PublicKey, error) {
+	keys := make(map[string]ed25519.PublicKey)
+	for name, loc := range t.Locations {
+		if loc.VerifyKey == "" {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(loc.VerifyKey)
+		if err != nil || len(b) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid verify key for %s", name)
+		}
+		keys[name] = ed25519.PublicKey(b)
+	}
+	return keys, nil
+}
+
+// SigningKeys reads the private keys of the given locations, i.e. those run locally.
+func (t *Topology) SigningKeys(locations ...string) (map[string]ed25519.PrivateKey, error) {
+	keys := make(map[string]ed25519.PrivateKey)
+	for _, name := range locations {
+		key, err := t.readKey(name, "signing", t.Locations[name].SigningKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if len(key) != ed25519.PrivateKeySize {
+			return nil, fmt.Errorf("invalid signing key for %s", name)
+		}
+		keys[name] = ed25519.PrivateKey(key)
+	}
+	return keys, nil
+}
+
+// EncryptionKeys returns the public encryption keys of the locations that have one.
+func (t *Topology) EncryptionKeys() (map[string]*ecdh.PublicKey, error) {
+	keys := make(map[string]*ecdh.PublicKey)
+	for name, loc := range t.Locations {
+		if loc.EncryptionKey == "" {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(loc.EncryptionKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key for %s", name)
+		}
+		if keys[name], err = ecdh.X25519().NewPublicKey(b); err != nil {
+			return nil, fmt.Errorf("invalid encryption key for %s: %w", name, err)
+		}
+	}
+	return keys, nil
+}
+
+// DecryptionKeys reads the private encryption keys of the given locations.
+func (t *Topology) DecryptionKeys(locations ...string) (map[string]*ecdh.PrivateKey, error) {
+	keys := make(map[string]*ecdh.PrivateKey)
+	for _, name := range locations {
+		b, err := t.readKey(name, "decryption", t.Locations[name].DecryptionKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if keys[name], err = ecdh.X25519().NewPrivateKey(b); err != nil {
+			return nil, fmt.Errorf("invalid decryption key for %s: %w", name, err)
+		}
+	}
+	return keys, nil
+}
+
+// readKey reads a base64 key from a file named in the topology.
+func (t *Topology) readKey(location, kind, file string) ([]byte, error) {
+	if file == "" {
+		return nil, fmt.Errorf("no %s key file for %s", kind, location)
+	}
+	b, err := os.ReadFile(t.path(file))
+	if err != nil {
+		return nil, fmt.Errorf("reading %s key for %s: %w", kind, location, err)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s key for %s", kind, location)
+	}
+	return key, nil
+}
+
+// path resolves a file named in the topology relative to it.
+func (t *Topology) path(name string) string {
+	if filepath.IsAbs(name) || t.dir == "" {
+		return name
+	}
+	return filepath.Join(t.dir, name)
+}
+
+// GenerateSigningKey returns a new base64 Ed25519 key pair, for a location's
+// VerifyKey and the contents of its SigningKeyFile.
+func GenerateSigningKey() (verifyKey, signingKey string, err error) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(public), base64.StdEncoding.EncodeToString(private), nil
+}
+
+// GenerateEncryptionKey returns a new base64 X25519 key pair, for a location's
+// EncryptionKey and the contents of its DecryptionKeyFile.
+func GenerateEncryptionKey() (encryptionKey, decryptionKey string, err error) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(private.PublicKey().Bytes()), base64.StdEncoding.EncodeToString(private.Bytes()), nil
+}
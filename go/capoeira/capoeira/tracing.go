@@ -0,0 +1,72 @@
+package capoeira
+
+import (
+	"context"
+	"crypto/sha256"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/danielc-lh/scripts/capoeira"
+
+// propagator carries trace context in message envelopes, independent of the global one.
+var propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// InjectTrace writes the trace context of ctx into a message envelope.
+func InjectTrace(ctx context.Context, carrier propagation.TextMapCarrier) {
+	propagator.Inject(ctx, carrier)
+}
+
+// ExtractTrace returns ctx extended with the trace context found in a message envelope.
+func ExtractTrace(ctx context.Context, carrier propagation.TextMapCarrier) context.Context {
+	return propagator.Extract(ctx, carrier)
+}
+
+// traceFields returns the envelope fields that InjectTrace may write.
+func traceFields() []string {
+	return propagator.Fields()
+}
+
+// sessionTrace parents ctx under a remote span derived from the session, so endpoints
+// of the same session in different processes report to the same trace. Contexts that
+// already carry a span are returned unchanged.
+func sessionTrace(ctx context.Context, session string) context.Context {
+	if session == "" || trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx
+	}
+	sum := sha256.Sum256([]byte("capoeira session " + session))
+	var traceID trace.TraceID
+	var spanID trace.SpanID
+	copy(traceID[:], sum[:16])
+	copy(spanID[:], sum[16:24])
+	return trace.ContextWithRemoteSpanContext(ctx, trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	}))
+}
+
+// tracer returns the tracer from provider, or from the global provider if nil.
+func tracer(provider trace.TracerProvider) trace.Tracer {
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+	return provider.Tracer(tracerName)
+}
+
+// span starts a child span of the op's context for one choreographic operation.
+func (op ProjectorChoreoOp) span(name string, seq uint64, peers ...string) (context.Context, trace.Span) {
+	ctx := op.context()
+	if op.tracer == nil {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	return op.tracer.Start(ctx, "capoeira."+name, trace.WithAttributes(
+		attribute.String("capoeira.location", op.Target.Name()),
+		attribute.Int64("capoeira.seq", int64(seq)),
+		attribute.StringSlice("capoeira.peers", peers),
+	))
+}
@@ -0,0 +1,44 @@
+package capoeira
+
+import (
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestSessionSharesOneTrace(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	transport := NewChannelTransport([]string{Seller{}.Name(), Buyer{}.Name()})
+
+	done := make(chan struct{})
+	go func() {
+		seller := NewProjector(Seller{}, transport)
+		seller.Session, seller.TracerProvider = "books-1", provider
+		seller.EppAndRun(BooksellerChoreography{Title: seller.Remote(Buyer{}), Budget: seller.Remote(Buyer{})})
+		close(done)
+	}()
+	buyer := NewProjector(Buyer{}, transport)
+	buyer.Session, buyer.TracerProvider = "books-1", provider
+	buyer.EppAndRun(BooksellerChoreography{Title: buyer.Local("TAPL"), Budget: buyer.Local(BUDGET)})
+	<-done
+
+	spans := recorder.Ended()
+	if len(spans) == 0 {
+		t.Fatal("expected spans to be recorded")
+	}
+	traceID := spans[0].SpanContext().TraceID()
+	linked := 0
+	for _, span := range spans {
+		if span.SpanContext().TraceID() != traceID {
+			t.Errorf("span %s is in trace %s, expected %s", span.Name(), span.SpanContext().TraceID(), traceID)
+		}
+		linked += len(span.Links())
+	}
+	// each side sends its handshake, the buyer the title and decision, and the seller
+	// the price and delivery date
+	if linked != 6 {
+		t.Errorf("expected 6 receives linked to their senders, got %d", linked)
+	}
+}
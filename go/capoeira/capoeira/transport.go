@@ -1,8 +1,35 @@
 package capoeira
 
+import "context"
+
 // Transport provides methods to send and receive messages between locations.
 type Transport interface {
 	Send(from, to string, data interface{})
 	Receive(from, at string) interface{}
 	Locations() []string
 }
+
+// ContextTransport is implemented by transports that carry a context with each message,
+// propagating its trace context in the message envelope.
+type ContextTransport interface {
+	Transport
+	SendContext(ctx context.Context, from, to string, data interface{}) error
+	// ReceiveContext waits for the next message until ctx is done. It returns ctx
+	// extended with the trace context the sender propagated.
+	ReceiveContext(ctx context.Context, from, at string) (interface{}, context.Context, error)
+}
+
+// CodecTransport is implemented by transports that say how messages are encoded on
+// the way, which endpoints compare before a run when their projectors shake hands.
+type CodecTransport interface {
+	Transport
+	Codec() string
+}
+
+// codecOf returns the codec of t, or "" if it doesn't say.
+func codecOf(t Transport) string {
+	if ct, ok := t.(CodecTransport); ok {
+		return ct.Codec()
+	}
+	return ""
+}
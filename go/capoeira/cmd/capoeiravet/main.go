@@ -0,0 +1,15 @@
+// capoeiravet runs the capoeira location-safety analyzer.
+//
+// It can be run directly or through go vet:
+//
+//	go vet -vettool=$(which capoeiravet) ./...
+package main
+
+import (
+	"github.com/danielc-lh/scripts/capoeira/locsafety"
+	"golang.org/x/tools/go/analysis/singlechecker"
+)
+
+func main() {
+	singlechecker.Main(locsafety.Analyzer)
+}
@@ -1,12 +1,40 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"os"
+	"strings"
 
 	"github.com/danielc-lh/scripts/capoeira"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
 func main() {
+	list := flag.Bool("list", false, "list the registered choreographies and exit")
+	flag.Parse()
+	if *list {
+		for _, info := range capoeira.Choreographies() {
+			fmt.Printf("%s (version %s): %s\n\t%s\n", info.Name, info.Version, strings.Join(info.Locations, ", "), info.Description)
+		}
+		return
+	}
+
+	// CAPOEIRA_TRACE=stdout prints a span per run and per communication
+	if os.Getenv("CAPOEIRA_TRACE") == "stdout" {
+		exporter, err := stdouttrace.New(stdouttrace.WithPrettyPrint())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to create trace exporter: %v\n", err)
+			os.Exit(1)
+		}
+		provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+		defer provider.Shutdown(context.Background())
+		otel.SetTracerProvider(provider)
+	}
+
 	// fmt.Println("Starting Bookseller Protocol Example")
 	// localTransport := capoeira.NewChannelTransport(capoeira.Seller{}.Name(), capoeira.Buyer{}.Name())
 	// httpTransport := capoeira.NewHTTPTransport([]string{capoeira.Seller{}.Name(), capoeira.Buyer{}.Name()})